@@ -0,0 +1,107 @@
+package apierror
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// Machine-readable error codes returned in the "code" field.
+const (
+	CodeInvalidJSON         = "invalid_json"
+	CodeValidationFailed    = "validation_failed"
+	CodeUnexpectedInput     = "unexpected_input"
+	CodeAuthHeaderForbidden = "authorization_not_allowed"
+	CodeAuthRequired        = "authentication_required"
+	CodeInvalidCredentials  = "invalid_credentials"
+	CodeInvalidToken        = "invalid_token"
+	CodeTokenExpired        = "token_expired"
+	CodeAccountLocked       = "account_locked"
+	CodeEmailNotVerified    = "email_not_verified"
+	CodeEmailExists         = "email_already_exists"
+	CodeRateLimited         = "rate_limited"
+	CodeNotFound            = "not_found"
+	CodeMethodNotAllowed    = "method_not_allowed"
+	CodeServiceUnavailable  = "service_unavailable"
+	CodeInternal            = "internal_error"
+)
+
+// FieldError describes why a single request field was rejected.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Response is the error envelope written by every handler and middleware.
+type Response struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Details []FieldError `json:"details,omitempty"`
+}
+
+// Abort writes the error envelope with status and stops the handler chain.
+func Abort(c *gin.Context, status int, code, message string) {
+	c.AbortWithStatusJSON(status, Response{Code: code, Message: message})
+}
+
+// AbortWithDetails is Abort with field-level details.
+func AbortWithDetails(c *gin.Context, status int, code, message string, details []FieldError) {
+	c.AbortWithStatusJSON(status, Response{Code: code, Message: message, Details: details})
+}
+
+// Internal aborts with a generic 500 that leaks no detail to the client.
+func Internal(c *gin.Context) {
+	Abort(c, http.StatusInternalServerError, CodeInternal, "An unexpected error occurred")
+}
+
+// Validation aborts with a 400 listing every failed validator rule.
+func Validation(c *gin.Context, err error) {
+	var validationErrors validator.ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		Abort(c, http.StatusBadRequest, CodeValidationFailed, err.Error())
+		return
+	}
+
+	details := make([]FieldError, 0, len(validationErrors))
+	for _, fe := range validationErrors {
+		details = append(details, FieldError{
+			Field:   fe.Field(),
+			Code:    fe.Tag(),
+			Message: fieldMessage(fe),
+		})
+	}
+	AbortWithDetails(c, http.StatusBadRequest, CodeValidationFailed, "Request validation failed", details)
+}
+
+func fieldMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return fmt.Sprintf("%s is required", fe.Field())
+	case "email":
+		return fmt.Sprintf("%s must be a valid email address", fe.Field())
+	case "min", "max":
+		return fmt.Sprintf("%s must satisfy %s=%s", fe.Field(), fe.Tag(), fe.Param())
+	default:
+		return fmt.Sprintf("%s failed the %s rule", fe.Field(), fe.Tag())
+	}
+}
+
+// NewValidator returns a validator that reports fields by their JSON name,
+// so FieldError.Field matches what the client sent.
+func NewValidator() *validator.Validate {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" || name == "" {
+			return field.Name
+		}
+		return name
+	})
+	return v
+}
@@ -0,0 +1,33 @@
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidationReportsJSONFieldNames(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	request := struct {
+		FirstName string `json:"first_name" validate:"required"`
+		Username  string `json:"username" validate:"required,email"`
+	}{Username: "not-an-email"}
+
+	Validation(c, NewValidator().Struct(request))
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var response Response
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, CodeValidationFailed, response.Code)
+	assert.Equal(t, []FieldError{
+		{Field: "first_name", Code: "required", Message: "first_name is required"},
+		{Field: "username", Code: "email", Message: "username must be a valid email address"},
+	}, response.Details)
+}
@@ -2,43 +2,71 @@ package health
 
 import (
 	"net/http"
+	"sync/atomic"
+	"webapp/api/apierror"
+	"webapp/db"
 	"webapp/logger"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
 )
 
-func HealthCheckHandler(db *gorm.DB) gin.HandlerFunc {
+// draining is set once the server starts shutting down.
+var draining int32
+
+// SetDraining makes the health check fail so load balancers stop sending new
+// requests while in-flight ones finish.
+func SetDraining(d bool) {
+	var v int32
+	if d {
+		v = 1
+	}
+	atomic.StoreInt32(&draining, v)
+}
+
+func HealthCheckHandler(database *db.Provider) gin.HandlerFunc {
 	return func(c *gin.Context) {
 
 		if c.Request.ContentLength > 0 {
-			logger.Logger.Error("HealthCheckHandler() - Bad Request")
-			c.Status(http.StatusBadRequest)
+			logger.FromContext(c).Error("HealthCheckHandler() - Bad Request")
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeUnexpectedInput, "Request must not include a body or query parameters")
 			return
 		}
 
 		if len(c.Request.URL.RawQuery) > 0 {
-			logger.Logger.Error("HealthCheckHandler() - Bad Request")
-			c.Status(http.StatusBadRequest)
+			logger.FromContext(c).Error("HealthCheckHandler() - Bad Request")
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeUnexpectedInput, "Request must not include a body or query parameters")
 			return
 		}
 
 		// c.Header("Cache-Control", "no-cache")
 
-		postgresDB, err := db.DB()
+		if atomic.LoadInt32(&draining) == 1 {
+			logger.FromContext(c).Info("HealthCheckHandler() - ServiceUnavailable, server is draining")
+			apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeServiceUnavailable, "Server is shutting down")
+			return
+		}
+
+		conn, err := database.DB()
+		if err != nil {
+			logger.FromContext(c).Error("HealthCheckHandler() - ServiceUnavailable, database not connected yet")
+			apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeServiceUnavailable, "Database is unavailable")
+			return
+		}
+
+		postgresDB, err := conn.DB()
 		if err != nil {
-			logger.Logger.Error("HealthCheckHandler() - ServiceUnavailable, cannot connect to db")
-			c.Status(http.StatusServiceUnavailable)
+			logger.FromContext(c).Error("HealthCheckHandler() - ServiceUnavailable, cannot connect to db")
+			apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeServiceUnavailable, "Database is unavailable")
 			return
 		}
 
 		if err := postgresDB.Ping(); err != nil {
-			logger.Logger.Error("HealthCheckHandler() - ServiceUnavailable, cannot ping db")
-			c.Status(http.StatusServiceUnavailable)
+			logger.FromContext(c).Error("HealthCheckHandler() - ServiceUnavailable, cannot ping db")
+			apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeServiceUnavailable, "Database is unavailable")
 			return
 		}
 
-		logger.Logger.Info("HealthCheckHandler() - Database health is OK")
+		logger.FromContext(c).Info("HealthCheckHandler() - Database health is OK")
 		c.Status(http.StatusOK)
 	}
 }
@@ -0,0 +1,245 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"webapp/api/apierror"
+	"webapp/api/user"
+	"webapp/db"
+	"webapp/db/migrations"
+	"webapp/logger"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CheckTimeout bounds each readiness check.
+var CheckTimeout = 2 * time.Second
+
+// Check is a dependency consulted by the readiness probe.
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// CheckResult is the outcome of a single check as reported in verbose mode.
+type CheckResult struct {
+	Name      string  `json:"name"`
+	OK        bool    `json:"ok"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+	// LastError is the most recent failure, kept after the check recovers.
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+type readinessReport struct {
+	Ready    bool          `json:"ready"`
+	Draining bool          `json:"draining,omitempty"`
+	Checks   []CheckResult `json:"checks"`
+}
+
+type failure struct {
+	err string
+	at  time.Time
+}
+
+// Readiness runs its checks on every probe and remembers the last failure of
+// each.
+type Readiness struct {
+	checks []Check
+
+	mu       sync.Mutex
+	failures map[string]failure
+}
+
+func NewReadiness(checks ...Check) *Readiness {
+	return &Readiness{checks: checks, failures: make(map[string]failure)}
+}
+
+// Run executes every check concurrently.
+func (r *Readiness) Run(ctx context.Context) []CheckResult {
+	results := make([]CheckResult, len(r.checks))
+	var wg sync.WaitGroup
+	for i, check := range r.checks {
+		wg.Add(1)
+		go func(i int, check Check) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, CheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check.Run(checkCtx)
+			results[i] = CheckResult{
+				Name:      check.Name,
+				OK:        err == nil,
+				LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		}(i, check)
+	}
+	wg.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range results {
+		result := &results[i]
+		if !result.OK {
+			r.failures[result.Name] = failure{err: result.Error, at: time.Now().UTC()}
+		}
+		if f, ok := r.failures[result.Name]; ok {
+			at := f.at
+			result.LastError = f.err
+			result.LastErrorAt = &at
+		}
+	}
+	return results
+}
+
+// Handler serves /readyz. It answers 200 once every check passes and 503
+// otherwise, including while the server drains. With ?verbose it returns a
+// JSON report of each check.
+func (r *Readiness) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > 0 {
+			logger.FromContext(c).Error("ReadinessHandler() - Bad Request")
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeUnexpectedInput, "Request must not include a body")
+			return
+		}
+
+		query := c.Request.URL.Query()
+		_, verbose := query["verbose"]
+		if len(query) > 1 || (len(query) == 1 && !verbose) {
+			logger.FromContext(c).Error("ReadinessHandler() - Bad Request")
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeUnexpectedInput, "Only the verbose query parameter is supported")
+			return
+		}
+
+		report := readinessReport{
+			Draining: atomic.LoadInt32(&draining) == 1,
+			Checks:   r.Run(c.Request.Context()),
+		}
+		report.Ready = !report.Draining
+		var failed []string
+		for _, result := range report.Checks {
+			if !result.OK {
+				report.Ready = false
+				failed = append(failed, result.Name)
+				logger.FromContext(c).Errorf("ReadinessHandler() - Check %s failed: %s", result.Name, result.Error)
+			}
+		}
+
+		status := http.StatusOK
+		if !report.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		if verbose {
+			c.JSON(status, report)
+			return
+		}
+
+		switch {
+		case report.Draining:
+			apierror.Abort(c, status, apierror.CodeServiceUnavailable, "Server is shutting down")
+		case len(failed) > 0:
+			apierror.Abort(c, status, apierror.CodeServiceUnavailable, "Not ready: "+strings.Join(failed, ", "))
+		default:
+			c.Status(status)
+		}
+	}
+}
+
+// LivenessHandler serves /livez. It only shows that the process is able to
+// answer, so it keeps passing while dependencies are down or the server
+// drains.
+func LivenessHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > 0 || len(c.Request.URL.RawQuery) > 0 {
+			logger.FromContext(c).Error("LivenessHandler() - Bad Request")
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeUnexpectedInput, "Request must not include a body or query parameters")
+			return
+		}
+		c.Status(http.StatusOK)
+	}
+}
+
+// DatabaseCheck pings Postgres.
+func DatabaseCheck(database *db.Provider) Check {
+	return Check{Name: "database", Run: func(ctx context.Context) error {
+		conn, err := database.DB()
+		if err != nil {
+			return err
+		}
+		sqlDB, err := conn.DB()
+		if err != nil {
+			return err
+		}
+		return sqlDB.PingContext(ctx)
+	}}
+}
+
+// MigrationsCheck fails while schema migrations are pending. Migrations are
+// only applied on connect, so once none are pending the result is kept and
+// later probes don't query the database again.
+func MigrationsCheck(database *db.Provider) Check {
+	var upToDate int32
+	return Check{Name: "migrations", Run: func(ctx context.Context) error {
+		if atomic.LoadInt32(&upToDate) == 1 {
+			return nil
+		}
+		conn, err := database.DB()
+		if err != nil {
+			return err
+		}
+		sqlDB, err := conn.DB()
+		if err != nil {
+			return err
+		}
+		pending, err := migrations.Pending(ctx, sqlDB)
+		if err != nil {
+			return err
+		}
+		if pending > 0 {
+			return fmt.Errorf("%d migrations pending", pending)
+		}
+		atomic.StoreInt32(&upToDate, 1)
+		return nil
+	}}
+}
+
+// PublisherCheckInterval is how long the result of a publisher ping is
+// reused. Pinging Pub/Sub is an API call, which should not be made on every
+// probe.
+var PublisherCheckInterval = time.Minute
+
+// PublisherCheck pings the message publisher at most once per
+// PublisherCheckInterval.
+func PublisherCheck(publisher user.Publisher) Check {
+	return Check{Name: "publisher", Run: cached(publisher.Ping, PublisherCheckInterval)}
+}
+
+// cached returns run wrapped so that its result, success or failure, is
+// reused for ttl.
+func cached(run func(ctx context.Context) error, ttl time.Duration) func(ctx context.Context) error {
+	var (
+		mu        sync.Mutex
+		lastErr   error
+		checkedAt time.Time
+	)
+	return func(ctx context.Context) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if !checkedAt.IsZero() && time.Since(checkedAt) < ttl {
+			return lastErr
+		}
+		lastErr = run(ctx)
+		checkedAt = time.Now()
+		return lastErr
+	}
+}
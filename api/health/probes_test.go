@@ -0,0 +1,94 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func serveReadiness(r *Readiness, target string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.GET("/readyz", r.Handler())
+	engine.GET("/livez", LivenessHandler())
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w
+}
+
+func TestReadinessReportsFailingChecks(t *testing.T) {
+	dbErr := errors.New("connection refused")
+	readiness := NewReadiness(
+		Check{Name: "database", Run: func(ctx context.Context) error { return dbErr }},
+		Check{Name: "publisher", Run: func(ctx context.Context) error { return nil }},
+	)
+
+	w := serveReadiness(readiness, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "database")
+
+	w = serveReadiness(readiness, "/readyz?verbose")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	var report readinessReport
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.False(t, report.Ready)
+	assert.Len(t, report.Checks, 2)
+	assert.False(t, report.Checks[0].OK)
+	assert.Equal(t, "connection refused", report.Checks[0].Error)
+	assert.True(t, report.Checks[1].OK)
+
+	// Once the dependency recovers the last error is still reported.
+	dbErr = nil
+	w = serveReadiness(readiness, "/readyz?verbose")
+	assert.Equal(t, http.StatusOK, w.Code)
+	report = readinessReport{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.True(t, report.Ready)
+	assert.Empty(t, report.Checks[0].Error)
+	assert.Equal(t, "connection refused", report.Checks[0].LastError)
+	assert.NotNil(t, report.Checks[0].LastErrorAt)
+}
+
+func TestReadinessFailsWhileDraining(t *testing.T) {
+	SetDraining(true)
+	defer SetDraining(false)
+
+	readiness := NewReadiness()
+	assert.Equal(t, http.StatusServiceUnavailable, serveReadiness(readiness, "/readyz").Code)
+	assert.Equal(t, http.StatusOK, serveReadiness(readiness, "/livez").Code)
+}
+
+func TestReadinessRejectsUnknownQuery(t *testing.T) {
+	assert.Equal(t, http.StatusBadRequest, serveReadiness(NewReadiness(), "/readyz?foo=bar").Code)
+	assert.Equal(t, http.StatusBadRequest, serveReadiness(NewReadiness(), "/livez?verbose").Code)
+}
+
+func TestCachedReusesResultUntilExpiry(t *testing.T) {
+	calls := 0
+	pingErr := errors.New("unreachable")
+	run := cached(func(ctx context.Context) error {
+		calls++
+		return pingErr
+	}, time.Hour)
+
+	assert.Equal(t, pingErr, run(context.Background()))
+	pingErr = nil
+	assert.Error(t, run(context.Background()))
+	assert.Equal(t, 1, calls)
+
+	run = cached(func(ctx context.Context) error {
+		calls++
+		return nil
+	}, 0)
+	assert.NoError(t, run(context.Background()))
+	assert.NoError(t, run(context.Background()))
+	assert.Equal(t, 3, calls)
+}
@@ -0,0 +1,259 @@
+package user
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"webapp/api/apierror"
+	"webapp/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Lifetimes of the tokens issued by LoginHandler and RefreshTokenHandler.
+var (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 7 * 24 * time.Hour
+)
+
+const tokenIssuer = "webapp"
+
+var signingKey []byte
+
+func init() {
+	// Fall back to a per-process key so tokens still work in local runs with
+	// the memory or file publisher, where no key is required; they just won't
+	// survive a restart or cross instances.
+	signingKey = make([]byte, 32)
+	if _, err := rand.Read(signingKey); err != nil {
+		panic(err)
+	}
+}
+
+// SetTokenSigningKey sets the HMAC key used to sign access tokens. All
+// instances behind a load balancer must share the same key.
+func SetTokenSigningKey(key []byte) {
+	signingKey = key
+}
+
+// AccessClaims are the claims carried by an access token. The subject is the
+// user ID.
+type AccessClaims struct {
+	Username string `json:"username"`
+	jwt.RegisteredClaims
+}
+
+// RefreshToken is a long-lived, single-use token that can be exchanged for a
+// new access token. Every refresh rotates the token within its family; if a
+// revoked token is presented again the whole family is revoked.
+type RefreshToken struct {
+	ID        uuid.UUID `gorm:"type:uuid;primaryKey"`
+	CreatedAt time.Time
+	UserID    uuid.UUID `gorm:"type:uuid;not null;index"`
+	FamilyID  uuid.UUID `gorm:"type:uuid;not null;index"`
+	TokenHash string    `gorm:"type:varchar(64);not null;uniqueIndex"`
+	ExpiresAt time.Time `gorm:"not null"`
+	RevokedAt *time.Time
+}
+
+// IssueAccessToken returns a signed access token for user and its expiry.
+func IssueAccessToken(user *UserModel) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(AccessTokenTTL)
+	claims := AccessClaims{
+		Username: user.Username,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokenIssuer,
+			Subject:   user.ID.String(),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			ID:        uuid.NewString(),
+		},
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(signingKey)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expiresAt, nil
+}
+
+// ParseAccessToken validates an access token and returns the user ID and
+// claims it carries.
+func ParseAccessToken(tokenString string) (uuid.UUID, *AccessClaims, error) {
+	var claims AccessClaims
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func(t *jwt.Token) (interface{}, error) {
+		return signingKey, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(tokenIssuer),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+
+	userID, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return uuid.Nil, nil, fmt.Errorf("invalid subject: %w", err)
+	}
+	return userID, &claims, nil
+}
+
+// newRefreshToken returns a refresh token of the user in family and the
+// token itself.
+func newRefreshToken(userID, familyID uuid.UUID) (*RefreshToken, string, error) {
+	token, hash, err := newToken()
+	if err != nil {
+		return nil, "", err
+	}
+	now := time.Now()
+	return &RefreshToken{
+		ID:        uuid.New(),
+		CreatedAt: now,
+		UserID:    userID,
+		FamilyID:  familyID,
+		TokenHash: hash,
+		ExpiresAt: now.Add(RefreshTokenTTL),
+	}, token, nil
+}
+
+// RevokeRefreshTokens revokes every active refresh token of a user in
+// Postgres. It is used on every password change, see
+// UserRepository.UpdateUser and VerificationRepository.ConsumePasswordReset,
+// and on account deletion.
+func RevokeRefreshTokens(tx *gorm.DB, userID uuid.UUID) error {
+	return tx.Model(&RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
+
+func tokenResponse(c *gin.Context, user *UserModel, refreshToken string) {
+	accessToken, expiresAt, err := IssueAccessToken(user)
+	if err != nil {
+		logger.FromContext(c).Error("tokenResponse() - Failed to sign access token")
+		apierror.Internal(c)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"access_token":       accessToken,
+		"token_type":         "Bearer",
+		"expires_in":         int(time.Until(expiresAt).Seconds()),
+		"refresh_token":      refreshToken,
+		"refresh_expires_in": int(RefreshTokenTTL.Seconds()),
+	})
+}
+
+// LoginHandler exchanges Basic credentials, already checked by
+// AuthenticationMiddleware, for an access token and a refresh token.
+func LoginHandler(store *Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetString("authMethod") != "basic" {
+			logger.FromContext(c).Error("LoginHandler() - Login requires Basic authentication")
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeAuthRequired, "Login requires Basic authentication")
+			return
+		}
+
+		user, err := store.Users.FindUserByID(c.Request.Context(), GetUserID(c))
+		if err != nil {
+			logger.FromContext(c).Error("LoginHandler() - Failed to retrieve user")
+			AbortStoreError(c, err)
+			return
+		}
+
+		refreshToken, token, err := newRefreshToken(user.ID, uuid.New())
+		if err != nil {
+			logger.FromContext(c).Error("LoginHandler() - Error generating refresh token")
+			apierror.Internal(c)
+			return
+		}
+		if err := store.Tokens.CreateRefreshToken(c.Request.Context(), refreshToken); err != nil {
+			logger.FromContext(c).Error("LoginHandler() - Failed to issue refresh token")
+			AbortStoreError(c, err)
+			return
+		}
+
+		logger.FromContext(c).Info("LoginHandler() - Tokens issued")
+		tokenResponse(c, user, token)
+		logger.FromContext(c).Debug("Completed Execution of LoginHandler")
+	}
+}
+
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+// RefreshTokenHandler rotates a refresh token and issues a new access token.
+func RefreshTokenHandler(store *Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request refreshTokenRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			logger.FromContext(c).Error("RefreshTokenHandler() - Error in json body")
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidJSON, "Request body must be valid JSON")
+			return
+		}
+
+		if validationErr := validate.Struct(request); validationErr != nil {
+			logger.FromContext(c).Error("RefreshTokenHandler() - Validation Error")
+			apierror.Validation(c, validationErr)
+			return
+		}
+
+		current, err := store.Tokens.FindRefreshToken(c.Request.Context(), hashToken(request.RefreshToken))
+		if errors.Is(err, ErrNotFound) {
+			logger.FromContext(c).Error("RefreshTokenHandler() - Unknown refresh token")
+			apierror.Abort(c, http.StatusUnauthorized, apierror.CodeInvalidToken, "Refresh token is invalid")
+			return
+		}
+		if err != nil {
+			logger.FromContext(c).Error("RefreshTokenHandler() - Failed to look up refresh token")
+			AbortStoreError(c, err)
+			return
+		}
+
+		if current.RevokedAt != nil {
+			// A rotated token was replayed; assume it leaked and end the whole
+			// session.
+			logger.FromContext(c).Error("RefreshTokenHandler() - Refresh token reuse detected, revoking family")
+			if err := store.Tokens.RevokeRefreshTokenFamily(c.Request.Context(), current.FamilyID); err != nil {
+				logger.FromContext(c).Errorf("RefreshTokenHandler() - Failed to revoke refresh token family: %v", err)
+			}
+			apierror.Abort(c, http.StatusUnauthorized, apierror.CodeInvalidToken, "Refresh token is invalid")
+			return
+		}
+
+		if time.Now().After(current.ExpiresAt) {
+			logger.FromContext(c).Error("RefreshTokenHandler() - Refresh token expired")
+			apierror.Abort(c, http.StatusUnauthorized, apierror.CodeTokenExpired, "Refresh token has expired")
+			return
+		}
+
+		next, token, err := newRefreshToken(current.UserID, current.FamilyID)
+		if err != nil {
+			logger.FromContext(c).Error("RefreshTokenHandler() - Error generating refresh token")
+			apierror.Internal(c)
+			return
+		}
+		user, err := store.Tokens.RotateRefreshToken(c.Request.Context(), current, next)
+		if errors.Is(err, ErrNotFound) {
+			logger.FromContext(c).Error("RefreshTokenHandler() - Invalid refresh token")
+			apierror.Abort(c, http.StatusUnauthorized, apierror.CodeInvalidToken, "Refresh token is invalid")
+			return
+		}
+		if err != nil {
+			logger.FromContext(c).Error("RefreshTokenHandler() - Failed to rotate refresh token")
+			AbortStoreError(c, err)
+			return
+		}
+
+		logger.FromContext(c).Info("RefreshTokenHandler() - Tokens refreshed")
+		tokenResponse(c, user, token)
+		logger.FromContext(c).Debug("Completed Execution of RefreshTokenHandler")
+	}
+}
@@ -0,0 +1,139 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type tokenResponseBody struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func loginForTokens(t *testing.T, engine *gin.Engine, id uuid.UUID) tokenResponseBody {
+	t.Helper()
+	w := serve(engine, http.MethodPost, "/v6/user/login", nil, id)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var tokens tokenResponseBody
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokens))
+	return tokens
+}
+
+func refresh(t *testing.T, engine *gin.Engine, refreshToken string) (int, tokenResponseBody) {
+	t.Helper()
+	w := serve(engine, http.MethodPost, "/v6/user/token/refresh", map[string]string{"refresh_token": refreshToken}, uuid.Nil)
+	var tokens tokenResponseBody
+	if w.Code == http.StatusOK {
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &tokens))
+	}
+	return w.Code, tokens
+}
+
+func TestLoginAndRefreshRotateTokens(t *testing.T) {
+	engine := newTestEngine(t, NewMemoryStore(), NewMemoryPublisher())
+	id := createTestUser(t, engine, "jane@example.com")
+
+	tokens := loginForTokens(t, engine, id)
+	subject, _, err := ParseAccessToken(tokens.AccessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, id, subject)
+
+	status, rotated := refresh(t, engine, tokens.RefreshToken)
+	assert.Equal(t, http.StatusOK, status)
+	assert.NotEqual(t, tokens.RefreshToken, rotated.RefreshToken)
+
+	status, _ = refresh(t, engine, "unknown")
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
+
+func TestPasswordChangeRevokesRefreshTokensInMemory(t *testing.T) {
+	engine := newTestEngine(t, NewMemoryStore(), NewMemoryPublisher())
+	id := createTestUser(t, engine, "jane@example.com")
+	tokens := loginForTokens(t, engine, id)
+
+	w := serve(engine, http.MethodPatch, "/v6/user/self", map[string]string{"password": "n3w-s3cret-password"}, id)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	status, _ := refresh(t, engine, tokens.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+}
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	engine := newTestEngine(t, NewMemoryStore(), NewMemoryPublisher())
+	id := createTestUser(t, engine, "jane@example.com")
+	tokens := loginForTokens(t, engine, id)
+
+	status, rotated := refresh(t, engine, tokens.RefreshToken)
+	assert.Equal(t, http.StatusOK, status)
+
+	// Presenting the rotated-out token again means it leaked, so the token
+	// that replaced it stops working too.
+	status, _ = refresh(t, engine, tokens.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	status, _ = refresh(t, engine, rotated.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// A new login starts a new family.
+	status, _ = refresh(t, engine, loginForTokens(t, engine, id).RefreshToken)
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestParseAccessToken(t *testing.T) {
+	user := &UserModel{ID: uuid.New(), Username: "jane@example.com"}
+	claims := func() AccessClaims {
+		now := time.Now()
+		return AccessClaims{
+			Username: user.Username,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    tokenIssuer,
+				Subject:   user.ID.String(),
+				IssuedAt:  jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+			},
+		}
+	}
+	sign := func(method jwt.SigningMethod, claims AccessClaims, key interface{}) string {
+		signed, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		assert.NoError(t, err)
+		return signed
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	issued, expiresAt, err := IssueAccessToken(user)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(AccessTokenTTL), expiresAt, time.Second)
+	subject, parsed, err := ParseAccessToken(issued)
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, subject)
+	assert.Equal(t, user.Username, parsed.Username)
+
+	expired := claims()
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute))
+	otherIssuer := claims()
+	otherIssuer.Issuer = "someone-else"
+	noExpiry := claims()
+	noExpiry.ExpiresAt = nil
+
+	for name, token := range map[string]string{
+		"alg none":     sign(jwt.SigningMethodNone, claims(), jwt.UnsafeAllowNoneSignatureType),
+		"alg RS256":    sign(jwt.SigningMethodRS256, claims(), rsaKey),
+		"wrong key":    sign(jwt.SigningMethodHS256, claims(), []byte("another-key-another-key-another!!")),
+		"expired":      sign(jwt.SigningMethodHS256, expired, signingKey),
+		"wrong issuer": sign(jwt.SigningMethodHS256, otherIssuer, signingKey),
+		"no expiry":    sign(jwt.SigningMethodHS256, noExpiry, signingKey),
+		"malformed":    "not-a-token",
+	} {
+		_, _, err := ParseAccessToken(token)
+		assert.Error(t, err, name)
+	}
+}
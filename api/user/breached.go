@@ -0,0 +1,97 @@
+package user
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// BreachedList looks passwords up in a local copy of the Pwned Passwords
+// SHA-1 corpus, as written by the haveibeenpwned downloader: one
+// "<SHA-1 in upper case hex>:<count>" line per password, sorted by hash. The
+// file is binary searched in place, so even the full corpus needs no memory.
+// Lines holding only the hash are accepted as well.
+type BreachedList struct {
+	file *os.File
+	size int64
+}
+
+// OpenBreachedList opens the list at path.
+func OpenBreachedList(path string) (*BreachedList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &BreachedList{file: file, size: info.Size()}, nil
+}
+
+func (l *BreachedList) Close() error {
+	return l.file.Close()
+}
+
+// Contains reports whether the SHA-1 of password is in the list.
+func (l *BreachedList) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	target := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	// lo is always the start of a line; the target line, if any, starts in
+	// [lo, hi).
+	lo, hi := int64(0), l.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, line, err := l.lineFrom(mid)
+		if errors.Is(err, io.EOF) {
+			hi = mid
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+
+		hash, _, _ := strings.Cut(strings.TrimSpace(line), ":")
+		switch strings.Compare(strings.ToUpper(hash), target) {
+		case 0:
+			return true, nil
+		case -1:
+			lo = start + int64(len(line))
+		default:
+			// No line starts in [mid, start).
+			hi = mid
+		}
+	}
+	return false, nil
+}
+
+// lineFrom returns the first line starting at or after offset, including its
+// newline, and where it starts. It returns io.EOF when there is none.
+func (l *BreachedList) lineFrom(offset int64) (int64, string, error) {
+	start := offset
+	if offset > 0 {
+		start = offset - 1
+	}
+	reader := bufio.NewReader(io.NewSectionReader(l.file, start, l.size-start))
+	if offset > 0 {
+		// Skip the rest of the line offset falls into. Reading from the
+		// byte before offset handles offset being a line start.
+		skipped, err := reader.ReadString('\n')
+		if err != nil {
+			return 0, "", err
+		}
+		start += int64(len(skipped))
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return 0, "", err
+	}
+	return start, line, nil
+}
@@ -0,0 +1,96 @@
+package user
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"webapp/api/apierror"
+	"webapp/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// AccountDeletionGracePeriod is how long a soft-deleted account keeps its
+// username before AccountPurger removes it for good.
+var AccountDeletionGracePeriod = 30 * 24 * time.Hour
+
+// DeleteUserHandler soft-deletes the authenticated user. The account can no
+// longer log in, its pending verification, reset and email change tokens are
+// removed and its refresh tokens revoked. The row itself is purged by
+// AccountPurger once AccountDeletionGracePeriod has passed.
+func DeleteUserHandler(store *Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > 0 || len(c.Request.URL.Query()) > 0 {
+			logger.FromContext(c).Error("DeleteUserHandler() - Unexpected body or query parameters")
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeUnexpectedInput, "Request must not include a body or query parameters")
+			return
+		}
+
+		userID := GetUserID(c)
+
+		if err := store.Users.DeleteUser(c.Request.Context(), userID); err != nil {
+			logger.FromContext(c).Error("DeleteUserHandler() - Failed to delete user")
+			AbortStoreError(c, err)
+			return
+		}
+
+		logger.FromContext(c).WithFields(logrus.Fields{
+			"id":       userID,
+			"purge_at": time.Now().Add(AccountDeletionGracePeriod).UTC().Format(time.RFC3339),
+		}).Info("DeleteUserHandler() - User deleted")
+		c.Status(http.StatusNoContent)
+		logger.FromContext(c).Debug("Completed Execution of DeleteUserHandler")
+	}
+}
+
+// AccountPurger permanently removes soft-deleted accounts whose grace period
+// has expired, together with the rows that reference them, freeing their
+// usernames for new signups. It also sweeps login failure counts that have
+// expired, so failed logins against random usernames don't pile up.
+type AccountPurger struct {
+	store    *Store
+	Interval time.Duration
+}
+
+func NewAccountPurger(store *Store) *AccountPurger {
+	return &AccountPurger{store: store, Interval: time.Hour}
+}
+
+// Run purges expired accounts and login attempts until ctx is cancelled.
+func (p *AccountPurger) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.purge(ctx); err != nil {
+			logger.Logger.Errorf("AccountPurger.Run() - Failed to purge expired records: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *AccountPurger) purge(ctx context.Context) error {
+	purged, err := p.store.Users.PurgeDeletedUsers(ctx, time.Now().Add(-AccountDeletionGracePeriod))
+	if err != nil {
+		return err
+	}
+	if purged > 0 {
+		logger.Logger.WithField("count", purged).Info("AccountPurger.purge() - Purged deleted accounts")
+	}
+
+	pruned, err := p.store.Lockouts.PruneLoginAttempts(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	if pruned > 0 {
+		logger.Logger.WithField("count", pruned).Info("AccountPurger.purge() - Pruned expired login attempts")
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package user
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeleteUserHandlerSoftDeletesAndPurgerRemovesAfterGracePeriod(t *testing.T) {
+	grace := AccountDeletionGracePeriod
+	t.Cleanup(func() { AccountDeletionGracePeriod = grace })
+	AccountDeletionGracePeriod = time.Hour
+
+	repo := NewMemoryRepository()
+	store := &Store{Users: repo, Verifications: repo, Lockouts: repo, Tokens: repo, Outbox: repo}
+	engine := newTestEngine(t, store, NewMemoryPublisher())
+	id := createTestUser(t, engine, "jane@example.com")
+	tokens := loginForTokens(t, engine, id)
+
+	w := serve(engine, http.MethodPost, "/v6/user/password/reset/request", map[string]string{"username": "jane@example.com"}, uuid.Nil)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	w = serve(engine, http.MethodPost, "/v6/user/self/email", map[string]string{"email": "new@example.com"}, id)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.NoError(t, repo.RecordLoginFailure(context.Background(), "jane@example.com", "192.0.2.1"))
+
+	w = serve(engine, http.MethodDelete, "/v6/user/self", nil, id)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, w.Body.String())
+
+	// Neither Basic nor Bearer authentication finds the account any more,
+	// and its refresh token is revoked.
+	assert.False(t, ValidateCredentials(context.Background(), repo, "jane@example.com", "s3cret-password"))
+	w = serve(engine, http.MethodGet, "/v6/user/self", nil, id)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	subject, _, err := ParseAccessToken(tokens.AccessToken)
+	assert.NoError(t, err)
+	_, err = repo.FindUserByID(context.Background(), subject)
+	assert.ErrorIs(t, err, ErrNotFound, "AuthenticationMiddleware rejects the access token's subject")
+	status, _ := refresh(t, engine, tokens.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	repo.mu.Lock()
+	assert.NotContains(t, repo.verifications, "jane@example.com")
+	assert.NotContains(t, repo.resets, "jane@example.com")
+	assert.NotContains(t, repo.emailChanges, id)
+	assert.Contains(t, repo.users, id, "the row is kept during the grace period")
+	repo.mu.Unlock()
+
+	// A second delete, e.g. a racing request, finds nothing.
+	assert.ErrorIs(t, repo.DeleteUser(context.Background(), id), ErrNotFound)
+
+	purger := NewAccountPurger(store)
+	assert.NoError(t, purger.purge(context.Background()))
+	exists, err := repo.UsernameExists(context.Background(), "jane@example.com")
+	assert.NoError(t, err)
+	assert.True(t, exists, "the username stays reserved until the grace period ends")
+
+	AccountDeletionGracePeriod = 0
+	assert.NoError(t, purger.purge(context.Background()))
+	exists, err = repo.UsernameExists(context.Background(), "jane@example.com")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	assert.NotContains(t, repo.users, id)
+	assert.NotContains(t, repo.attempts, usernameLockoutKey("jane@example.com"))
+	for _, token := range repo.refreshTokens {
+		assert.NotEqual(t, id, token.UserID)
+	}
+}
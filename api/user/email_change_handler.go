@@ -0,0 +1,168 @@
+package user
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"webapp/api/apierror"
+	"webapp/logger"
+	"webapp/ratelimit"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// EmailChange is a pending change of a user's email address, and so of the
+// username. The username is only replaced once the token sent to the new
+// address comes back through /verify, so the account stays verified
+// throughout. Confirming also verifies an account that was not yet verified,
+// since the user has just proven they own the new address. A user has at most
+// one pending change.
+type EmailChange struct {
+	UserID     uuid.UUID `gorm:"type:uuid;primaryKey"`
+	NewEmail   string    `gorm:"type:varchar(100);not null"`
+	TokenHash  string    `gorm:"type:varchar(64);uniqueIndex"`
+	ExpiryTime time.Time
+}
+
+type emailChangeRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+// RequestEmailChangeHandler starts changing the authenticated user's email
+// address. A verification message is queued for the new address; the token
+// it carries is confirmed by VerifyUserHandler. It shares the limits of
+// ResendVerificationHandler, counted per user.
+func RequestEmailChangeHandler(store *Store) gin.HandlerFunc {
+	limiter := ratelimit.New(ResendEmailLimit, ResendWindow)
+
+	return func(c *gin.Context) {
+		var request emailChangeRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			logger.FromContext(c).Error("RequestEmailChangeHandler() - Error in json body")
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidJSON, "Request body must be valid JSON")
+			return
+		}
+
+		request.Email = NormalizeUsername(request.Email)
+
+		if validationErr := validate.Struct(request); validationErr != nil {
+			logger.FromContext(c).Error("RequestEmailChangeHandler() - Validation Error")
+			apierror.Validation(c, validationErr)
+			return
+		}
+
+		userID := GetUserID(c)
+		if ok, retryAfter := limiter.Allow(userID.String()); !ok {
+			logger.FromContext(c).Error("RequestEmailChangeHandler() - Rate limit exceeded for user")
+			tooManyRequests(c, retryAfter)
+			return
+		}
+
+		if request.Email == c.GetString("username") {
+			logger.FromContext(c).Error("RequestEmailChangeHandler() - New email equals the current one")
+			apierror.AbortWithDetails(c, http.StatusBadRequest, apierror.CodeValidationFailed, "Request validation failed", []apierror.FieldError{
+				{Field: "email", Code: "unchanged", Message: "email is already the account's email address"},
+			})
+			return
+		}
+
+		exists, err := store.Users.UsernameExists(c.Request.Context(), request.Email)
+		if err != nil {
+			logger.FromContext(c).Error("RequestEmailChangeHandler() - Failed to check for existing email")
+			AbortStoreError(c, err)
+			return
+		}
+		if exists {
+			logger.FromContext(c).Error("RequestEmailChangeHandler() - Email-id already exists")
+			emailExists(c)
+			return
+		}
+
+		token, hash, err := newToken()
+		if err != nil {
+			logger.FromContext(c).Error("RequestEmailChangeHandler() - Error generating verification token")
+			apierror.Internal(c)
+			return
+		}
+		change := &EmailChange{
+			UserID:     userID,
+			NewEmail:   request.Email,
+			TokenHash:  hash,
+			ExpiryTime: time.Now().Add(VerificationTokenTTL),
+		}
+		outboxMsg, err := newOutboxMessage(c.Request.Context(), VerificationTopic, VerificationMessage{
+			Email:             request.Email,
+			VerificationToken: token,
+		}, map[string]string{
+			"email":   request.Email,
+			"purpose": "email_change",
+		})
+		if err != nil {
+			logger.FromContext(c).Error("RequestEmailChangeHandler() - Error building verification message")
+			apierror.Internal(c)
+			return
+		}
+
+		if err := store.Verifications.RequestEmailChange(c.Request.Context(), change, outboxMsg); err != nil {
+			logger.FromContext(c).Error("RequestEmailChangeHandler() - Failed to save email change")
+			AbortStoreError(c, err)
+			return
+		}
+
+		logger.FromContext(c).WithFields(logrus.Fields{
+			"id":        userID,
+			"new_email": request.Email,
+		}).Info("RequestEmailChangeHandler() - Email change verification queued")
+		c.JSON(http.StatusAccepted, gin.H{"message": "Verification email sent to the new address"})
+		logger.FromContext(c).Debug("Completed Execution of RequestEmailChangeHandler")
+	}
+}
+
+// confirmEmailChange completes the email change whose token hashes to
+// tokenHash. It is called by VerifyUserHandler for tokens that are not
+// signup verifications.
+func confirmEmailChange(c *gin.Context, store *Store, tokenHash string) {
+	change, err := store.Verifications.FindEmailChange(c.Request.Context(), tokenHash)
+	if errors.Is(err, ErrNotFound) {
+		logger.FromContext(c).Error("VerifyUserHandler() - Token not found")
+		apierror.Abort(c, http.StatusNotFound, apierror.CodeInvalidToken, "Token is invalid or has already been used")
+		return
+	}
+	if err != nil {
+		logger.FromContext(c).Error("VerifyUserHandler() - Failed to look up email change")
+		AbortStoreError(c, err)
+		return
+	}
+
+	if time.Now().After(change.ExpiryTime) {
+		logger.FromContext(c).Error("VerifyUserHandler() - Email change link expired")
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeTokenExpired, "Token has expired")
+		return
+	}
+
+	err = store.Verifications.ConsumeEmailChange(c.Request.Context(), change)
+	if errors.Is(err, ErrNotFound) {
+		logger.FromContext(c).Error("VerifyUserHandler() - Email change already confirmed or user not found")
+		apierror.Abort(c, http.StatusNotFound, apierror.CodeInvalidToken, "Token is invalid or has already been used")
+		return
+	}
+	if errors.Is(err, ErrUsernameTaken) {
+		logger.FromContext(c).Error("VerifyUserHandler() - New email was taken in the meantime")
+		emailExists(c)
+		return
+	}
+	if err != nil {
+		logger.FromContext(c).Error("VerifyUserHandler() - Failed to change email")
+		AbortStoreError(c, err)
+		return
+	}
+
+	logger.FromContext(c).WithFields(logrus.Fields{
+		"id":        change.UserID,
+		"new_email": change.NewEmail,
+	}).Info("Email address changed successfully")
+	c.JSON(http.StatusOK, gin.H{"message": "Email address changed successfully"})
+}
@@ -0,0 +1,115 @@
+package user
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// createVerifiedUser signs up username and confirms its address.
+func createVerifiedUser(t *testing.T, engine *gin.Engine, publisher *MemoryPublisher, username string) uuid.UUID {
+	id := createTestUser(t, engine, username)
+	messages := publisher.VerificationMessages(VerificationTopic)
+	token := messages[len(messages)-1].VerificationToken
+	w := serve(engine, http.MethodGet, "/verify?token="+token, nil, uuid.Nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	return id
+}
+
+func TestEmailChangeSwapsUsernameOnceConfirmed(t *testing.T) {
+	store := NewMemoryStore()
+	publisher := NewMemoryPublisher()
+	engine := newTestEngine(t, store, publisher)
+
+	id := createVerifiedUser(t, engine, publisher, "old@example.com")
+
+	w := serve(engine, http.MethodPost, "/v6/user/self/email", map[string]string{"email": " New@Example.com"}, id)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	messages := publisher.Messages()
+	last := messages[len(messages)-1]
+	assert.Equal(t, "new@example.com", last.Attributes["email"])
+	assert.Equal(t, "email_change", last.Attributes["purpose"])
+	verifications := publisher.VerificationMessages(VerificationTopic)
+	token := verifications[len(verifications)-1].VerificationToken
+
+	// Until the new address is confirmed the account keeps its username.
+	account, err := store.Users.FindUserByID(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, "old@example.com", account.Username)
+	assert.True(t, account.IsVerified)
+
+	w = serve(engine, http.MethodGet, "/verify?token="+token, nil, uuid.Nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	account, err = store.Users.FindUserByID(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, "new@example.com", account.Username)
+	assert.True(t, account.IsVerified)
+	_, err = store.Users.FindUserByUsername(context.Background(), "old@example.com")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	w = serve(engine, http.MethodGet, "/verify?token="+token, nil, uuid.Nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestEmailChangeRejectsTakenAddresses(t *testing.T) {
+	store := NewMemoryStore()
+	publisher := NewMemoryPublisher()
+	engine := newTestEngine(t, store, publisher)
+
+	first := createVerifiedUser(t, engine, publisher, "first@example.com")
+	second := createVerifiedUser(t, engine, publisher, "second@example.com")
+
+	w := serve(engine, http.MethodPost, "/v6/user/self/email", map[string]string{"email": "SECOND@example.com"}, first)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	w = serve(engine, http.MethodPost, "/v6/user/self/email", map[string]string{"email": "first@example.com"}, first)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "unchanged")
+
+	// Both users ask for the same free address; the first to confirm wins.
+	var tokens []string
+	for _, id := range []uuid.UUID{first, second} {
+		w = serve(engine, http.MethodPost, "/v6/user/self/email", map[string]string{"email": "shared@example.com"}, id)
+		assert.Equal(t, http.StatusAccepted, w.Code)
+		verifications := publisher.VerificationMessages(VerificationTopic)
+		tokens = append(tokens, verifications[len(verifications)-1].VerificationToken)
+	}
+
+	w = serve(engine, http.MethodGet, "/verify?token="+tokens[1], nil, uuid.Nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = serve(engine, http.MethodGet, "/verify?token="+tokens[0], nil, uuid.Nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	account, err := store.Users.FindUserByID(context.Background(), first)
+	assert.NoError(t, err)
+	assert.Equal(t, "first@example.com", account.Username)
+}
+
+func TestEmailChangeVerifiesAndDropsOldSignupToken(t *testing.T) {
+	store := NewMemoryStore()
+	publisher := NewMemoryPublisher()
+	engine := newTestEngine(t, store, publisher)
+
+	id := createTestUser(t, engine, "pending@example.com")
+	signupToken := publisher.VerificationMessages(VerificationTopic)[0].VerificationToken
+
+	w := serve(engine, http.MethodPost, "/v6/user/self/email", map[string]string{"email": "confirmed@example.com"}, id)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	verifications := publisher.VerificationMessages(VerificationTopic)
+	w = serve(engine, http.MethodGet, "/verify?token="+verifications[len(verifications)-1].VerificationToken, nil, uuid.Nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	account, err := store.Users.FindUserByID(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, "confirmed@example.com", account.Username)
+	assert.True(t, account.IsVerified)
+
+	w = serve(engine, http.MethodGet, "/verify?token="+signupToken, nil, uuid.Nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,202 @@
+package user
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"webapp/logger"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// LoginAttempt tracks consecutive failed logins for a username or client IP.
+// In Postgres lockouts survive restarts and apply across instances.
+type LoginAttempt struct {
+	Key           string `gorm:"primaryKey;type:varchar(255)"`
+	Failures      int    `gorm:"not null;default:0"`
+	LastFailureAt time.Time
+	BlockedUntil  *time.Time
+}
+
+// LockoutPolicy describes how failed logins are throttled. After
+// FreeAttempts failures every further attempt is delayed, starting at
+// BaseDelay and doubling per failure; after MaxAttempts failures the key is
+// locked for LockoutDuration. Failures are forgotten after ResetAfter
+// without another failure.
+type LockoutPolicy struct {
+	FreeAttempts    int
+	MaxAttempts     int
+	BaseDelay       time.Duration
+	LockoutDuration time.Duration
+	ResetAfter      time.Duration
+}
+
+// Policies applied to usernames and to client IPs. Client IPs get more
+// headroom since many users may share one address.
+var (
+	UsernameLockoutPolicy = LockoutPolicy{
+		FreeAttempts:    3,
+		MaxAttempts:     10,
+		BaseDelay:       time.Second,
+		LockoutDuration: 15 * time.Minute,
+		ResetAfter:      time.Hour,
+	}
+	IPLockoutPolicy = LockoutPolicy{
+		FreeAttempts:    20,
+		MaxAttempts:     100,
+		BaseDelay:       time.Second,
+		LockoutDuration: 15 * time.Minute,
+		ResetAfter:      time.Hour,
+	}
+)
+
+// blockFor returns how long a key is blocked after its n-th failure.
+func (p LockoutPolicy) blockFor(failures int) time.Duration {
+	if failures >= p.MaxAttempts {
+		return p.LockoutDuration
+	}
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures; i++ {
+		delay *= 2
+		if delay >= p.LockoutDuration {
+			return p.LockoutDuration
+		}
+	}
+	return delay
+}
+
+func usernameLockoutKey(username string) string {
+	return "user:" + strings.ToLower(username)
+}
+
+func ipLockoutKey(ip string) string {
+	return "ip:" + ip
+}
+
+// lockoutPolicyFor returns the policy that applies to key.
+func lockoutPolicyFor(key string) LockoutPolicy {
+	if strings.HasPrefix(key, ipLockoutKey("")) {
+		return IPLockoutPolicy
+	}
+	return UsernameLockoutPolicy
+}
+
+// expired reports whether attempt can be forgotten at now: its failures are
+// older than ResetAfter and it is no longer blocked.
+func (p LockoutPolicy) expired(attempt LoginAttempt, now time.Time) bool {
+	return now.Sub(attempt.LastFailureAt) > p.ResetAfter &&
+		(attempt.BlockedUntil == nil || !attempt.BlockedUntil.After(now))
+}
+
+// blockedFor returns how long the longest block among attempts still has to
+// run.
+func blockedFor(attempts []LoginAttempt, now time.Time) time.Duration {
+	var blocked time.Duration
+	for _, attempt := range attempts {
+		if attempt.BlockedUntil != nil && attempt.BlockedUntil.After(now) {
+			if remaining := attempt.BlockedUntil.Sub(now); remaining > blocked {
+				blocked = remaining
+			}
+		}
+	}
+	return blocked
+}
+
+// recordFailure counts another failure on attempt at now and blocks it as
+// the policy demands.
+func (p LockoutPolicy) recordFailure(attempt *LoginAttempt, now time.Time) {
+	if !attempt.LastFailureAt.IsZero() && now.Sub(attempt.LastFailureAt) > p.ResetAfter {
+		attempt.Failures = 0
+	}
+	attempt.Failures++
+	attempt.LastFailureAt = now
+	attempt.BlockedUntil = nil
+	delay := p.blockFor(attempt.Failures)
+	if delay == 0 {
+		return
+	}
+	blockedUntil := now.Add(delay)
+	attempt.BlockedUntil = &blockedUntil
+
+	entry := logger.Logger.WithFields(logrus.Fields{
+		"lockout_key":   attempt.Key,
+		"failures":      attempt.Failures,
+		"blocked_until": blockedUntil.UTC().Format(time.RFC3339),
+	})
+	if attempt.Failures >= p.MaxAttempts {
+		entry.Warn("recordFailure() - Login locked out")
+	} else {
+		entry.Warn("recordFailure() - Login throttled")
+	}
+}
+
+func (r *PostgresRepository) LoginBlockedFor(ctx context.Context, username, ip string) (time.Duration, error) {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var attempts []LoginAttempt
+	err = conn.Where("key IN ?", []string{usernameLockoutKey(username), ipLockoutKey(ip)}).Find(&attempts).Error
+	if err != nil {
+		return 0, err
+	}
+	return blockedFor(attempts, time.Now()), nil
+}
+
+func (r *PostgresRepository) RecordLoginFailure(ctx context.Context, username, ip string) error {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Transaction(func(tx *gorm.DB) error {
+		if err := recordFailure(tx, usernameLockoutKey(username), UsernameLockoutPolicy); err != nil {
+			return err
+		}
+		return recordFailure(tx, ipLockoutKey(ip), IPLockoutPolicy)
+	})
+}
+
+func recordFailure(tx *gorm.DB, key string, policy LockoutPolicy) error {
+	// Make sure the row exists, then lock it so concurrent failures on
+	// other instances are counted exactly once each.
+	err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&LoginAttempt{Key: key}).Error
+	if err != nil {
+		return err
+	}
+
+	var attempt LoginAttempt
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&attempt, "key = ?", key).Error; err != nil {
+		return err
+	}
+	policy.recordFailure(&attempt, time.Now())
+	return tx.Save(&attempt).Error
+}
+
+func (r *PostgresRepository) RecordLoginSuccess(ctx context.Context, username string) error {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Where("key = ?", usernameLockoutKey(username)).Delete(&LoginAttempt{}).Error
+}
+
+func (r *PostgresRepository) PruneLoginAttempts(ctx context.Context, now time.Time) (int, error) {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	// Mirrors LockoutPolicy.expired for both kinds of key.
+	result := conn.
+		Where("blocked_until IS NULL OR blocked_until <= ?", now).
+		Where(conn.
+			Where("key LIKE ? AND last_failure_at < ?", usernameLockoutKey("")+"%", now.Add(-UsernameLockoutPolicy.ResetAfter)).
+			Or("key LIKE ? AND last_failure_at < ?", ipLockoutKey("")+"%", now.Add(-IPLockoutPolicy.ResetAfter))).
+		Delete(&LoginAttempt{})
+	return int(result.RowsAffected), result.Error
+}
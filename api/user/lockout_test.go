@@ -0,0 +1,49 @@
+package user
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockoutPolicyBlockFor(t *testing.T) {
+	policy := LockoutPolicy{
+		FreeAttempts:    3,
+		MaxAttempts:     8,
+		BaseDelay:       time.Second,
+		LockoutDuration: 15 * time.Minute,
+	}
+
+	assert.Equal(t, time.Duration(0), policy.blockFor(1))
+	assert.Equal(t, time.Duration(0), policy.blockFor(3))
+	assert.Equal(t, time.Second, policy.blockFor(4))
+	assert.Equal(t, 2*time.Second, policy.blockFor(5))
+	assert.Equal(t, 8*time.Second, policy.blockFor(7))
+	assert.Equal(t, 15*time.Minute, policy.blockFor(8))
+	assert.Equal(t, 15*time.Minute, policy.blockFor(20))
+}
+
+func TestAccountPurgerPrunesExpiredLoginAttempts(t *testing.T) {
+	repo := NewMemoryRepository()
+	now := time.Now()
+	stillBlocked := now.Add(5 * time.Minute)
+	for _, attempt := range []LoginAttempt{
+		{Key: usernameLockoutKey("old@example.com"), Failures: 2, LastFailureAt: now.Add(-UsernameLockoutPolicy.ResetAfter - time.Minute)},
+		{Key: usernameLockoutKey("recent@example.com"), Failures: 2, LastFailureAt: now.Add(-time.Minute)},
+		{Key: usernameLockoutKey("locked@example.com"), Failures: 10, LastFailureAt: now.Add(-UsernameLockoutPolicy.ResetAfter - time.Minute), BlockedUntil: &stillBlocked},
+		{Key: ipLockoutKey("192.0.2.1"), Failures: 2, LastFailureAt: now.Add(-IPLockoutPolicy.ResetAfter - time.Minute)},
+		{Key: ipLockoutKey("192.0.2.2"), Failures: 2, LastFailureAt: now.Add(-time.Minute)},
+	} {
+		repo.attempts[attempt.Key] = attempt
+	}
+
+	assert.NoError(t, NewAccountPurger(&Store{Users: repo, Lockouts: repo}).purge(context.Background()))
+
+	assert.NotContains(t, repo.attempts, usernameLockoutKey("old@example.com"))
+	assert.NotContains(t, repo.attempts, ipLockoutKey("192.0.2.1"))
+	assert.Contains(t, repo.attempts, usernameLockoutKey("recent@example.com"))
+	assert.Contains(t, repo.attempts, usernameLockoutKey("locked@example.com"), "a block outlasting the window is kept")
+	assert.Contains(t, repo.attempts, ipLockoutKey("192.0.2.2"))
+}
@@ -0,0 +1,512 @@
+package user
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// MemoryRepository implements the repositories in memory. It is intended for
+// tests.
+type MemoryRepository struct {
+	mu            sync.Mutex
+	users         map[uuid.UUID]UserModel
+	verifications map[string]EmailVerification
+	emailChanges  map[uuid.UUID]EmailChange
+	resets        map[string]PasswordReset
+	attempts      map[string]LoginAttempt
+	refreshTokens map[uuid.UUID]RefreshToken
+	outbox        map[uuid.UUID]OutboxMessage
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		users:         make(map[uuid.UUID]UserModel),
+		verifications: make(map[string]EmailVerification),
+		emailChanges:  make(map[uuid.UUID]EmailChange),
+		resets:        make(map[string]PasswordReset),
+		attempts:      make(map[string]LoginAttempt),
+		refreshTokens: make(map[uuid.UUID]RefreshToken),
+		outbox:        make(map[uuid.UUID]OutboxMessage),
+	}
+}
+
+// NewMemoryStore returns a Store whose repositories share one
+// MemoryRepository.
+func NewMemoryStore() *Store {
+	repo := NewMemoryRepository()
+	return &Store{Users: repo, Verifications: repo, Lockouts: repo, Tokens: repo, Outbox: repo}
+}
+
+func (r *MemoryRepository) CreateUser(ctx context.Context, user *UserModel, verification *EmailVerification, msg *OutboxMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.usernameHeld(user.Username, uuid.Nil) {
+		return ErrUsernameTaken
+	}
+	now := time.Now()
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = now
+	}
+	if user.UpdatedAt.IsZero() {
+		user.UpdatedAt = now
+	}
+	r.users[user.ID] = *user
+	r.verifications[verification.Email] = *verification
+	r.outbox[msg.ID] = *msg
+	return nil
+}
+
+func (r *MemoryRepository) UsernameExists(ctx context.Context, username string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.usernameHeld(username, uuid.Nil), nil
+}
+
+func (r *MemoryRepository) FindUserByUsername(ctx context.Context, username string) (*UserModel, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if user, ok := r.userByUsername(username); ok {
+		return &user, nil
+	}
+	return nil, ErrNotFound
+}
+
+func (r *MemoryRepository) FindUserByID(ctx context.Context, id uuid.UUID) (*UserModel, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok || user.DeletedAt.Valid {
+		return nil, ErrNotFound
+	}
+	return &user, nil
+}
+
+func (r *MemoryRepository) UpdateUser(ctx context.Context, id uuid.UUID, changes UserModel) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok || user.DeletedAt.Valid {
+		return ErrNotFound
+	}
+	if changes.FirstName != "" {
+		user.FirstName = changes.FirstName
+	}
+	if changes.LastName != "" {
+		user.LastName = changes.LastName
+	}
+	if changes.Password != "" {
+		user.Password = changes.Password
+	}
+	if changes.Username != "" {
+		if r.usernameHeld(changes.Username, id) {
+			return ErrUsernameTaken
+		}
+		user.Username = changes.Username
+	}
+	if changes.Password != "" {
+		r.revokeRefreshTokens(id)
+	}
+	user.UpdatedAt = time.Now()
+	r.users[id] = user
+	return nil
+}
+
+func (r *MemoryRepository) ReplacePasswordHash(ctx context.Context, id uuid.UUID, oldHash, newHash string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok || user.DeletedAt.Valid || user.Password != oldHash {
+		return false, nil
+	}
+	user.Password = newHash
+	r.users[id] = user
+	return true, nil
+}
+
+func (r *MemoryRepository) RotateVerification(ctx context.Context, verification *EmailVerification, msg *OutboxMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.verifications[verification.Email] = *verification
+	r.outbox[msg.ID] = *msg
+	return nil
+}
+
+func (r *MemoryRepository) DeleteUser(ctx context.Context, id uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, ok := r.users[id]
+	if !ok || user.DeletedAt.Valid {
+		return ErrNotFound
+	}
+	delete(r.verifications, user.Username)
+	delete(r.resets, user.Username)
+	delete(r.emailChanges, id)
+	r.revokeRefreshTokens(id)
+	user.DeletedAt = gorm.DeletedAt{Time: time.Now(), Valid: true}
+	r.users[id] = user
+	return nil
+}
+
+func (r *MemoryRepository) PurgeDeletedUsers(ctx context.Context, cutoff time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	purged := 0
+	for id, user := range r.users {
+		if !user.DeletedAt.Valid || !user.DeletedAt.Time.Before(cutoff) {
+			continue
+		}
+		for tokenID, token := range r.refreshTokens {
+			if token.UserID == id {
+				delete(r.refreshTokens, tokenID)
+			}
+		}
+		delete(r.verifications, user.Username)
+		delete(r.resets, user.Username)
+		delete(r.emailChanges, id)
+		delete(r.attempts, usernameLockoutKey(user.Username))
+		delete(r.users, id)
+		purged++
+	}
+	return purged, nil
+}
+
+func (r *MemoryRepository) FindVerification(ctx context.Context, tokenHash string) (*EmailVerification, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, verification := range r.verifications {
+		if verification.TokenHash == tokenHash {
+			return &verification, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *MemoryRepository) ConsumeVerification(ctx context.Context, verification *EmailVerification) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.verifications[verification.Email]
+	if !ok || stored.TokenHash != verification.TokenHash {
+		return ErrNotFound
+	}
+	user, ok := r.userByUsername(verification.Email)
+	if !ok {
+		return ErrNotFound
+	}
+
+	delete(r.verifications, verification.Email)
+	user.IsVerified = true
+	r.users[user.ID] = user
+	return nil
+}
+
+func (r *MemoryRepository) RequestEmailChange(ctx context.Context, change *EmailChange, msg *OutboxMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.emailChanges[change.UserID] = *change
+	r.outbox[msg.ID] = *msg
+	return nil
+}
+
+func (r *MemoryRepository) FindEmailChange(ctx context.Context, tokenHash string) (*EmailChange, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, change := range r.emailChanges {
+		if change.TokenHash == tokenHash {
+			return &change, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *MemoryRepository) ConsumeEmailChange(ctx context.Context, change *EmailChange) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.emailChanges[change.UserID]
+	if !ok || stored.TokenHash != change.TokenHash {
+		return ErrNotFound
+	}
+	user, ok := r.users[change.UserID]
+	if !ok || user.DeletedAt.Valid {
+		return ErrNotFound
+	}
+	if r.usernameHeld(change.NewEmail, user.ID) {
+		return ErrUsernameTaken
+	}
+
+	delete(r.emailChanges, change.UserID)
+	delete(r.verifications, user.Username)
+	delete(r.resets, user.Username)
+	delete(r.attempts, usernameLockoutKey(user.Username))
+	user.Username = change.NewEmail
+	user.IsVerified = true
+	user.UpdatedAt = time.Now()
+	r.users[user.ID] = user
+	return nil
+}
+
+func (r *MemoryRepository) RequestPasswordReset(ctx context.Context, reset *PasswordReset, msg *OutboxMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.resets[reset.Email] = *reset
+	r.outbox[msg.ID] = *msg
+	return nil
+}
+
+func (r *MemoryRepository) LoginBlockedFor(ctx context.Context, username, ip string) (time.Duration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var attempts []LoginAttempt
+	for _, key := range []string{usernameLockoutKey(username), ipLockoutKey(ip)} {
+		if attempt, ok := r.attempts[key]; ok {
+			attempts = append(attempts, attempt)
+		}
+	}
+	return blockedFor(attempts, time.Now()), nil
+}
+
+func (r *MemoryRepository) RecordLoginFailure(ctx context.Context, username, ip string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for key, policy := range map[string]LockoutPolicy{
+		usernameLockoutKey(username): UsernameLockoutPolicy,
+		ipLockoutKey(ip):             IPLockoutPolicy,
+	} {
+		attempt, ok := r.attempts[key]
+		if !ok {
+			attempt = LoginAttempt{Key: key}
+		}
+		policy.recordFailure(&attempt, now)
+		r.attempts[key] = attempt
+	}
+	return nil
+}
+
+func (r *MemoryRepository) RecordLoginSuccess(ctx context.Context, username string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.attempts, usernameLockoutKey(username))
+	return nil
+}
+
+func (r *MemoryRepository) PruneLoginAttempts(ctx context.Context, now time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pruned := 0
+	for key, attempt := range r.attempts {
+		if lockoutPolicyFor(key).expired(attempt, now) {
+			delete(r.attempts, key)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+func (r *MemoryRepository) FindPasswordReset(ctx context.Context, tokenHash string) (*PasswordReset, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, reset := range r.resets {
+		if reset.TokenHash == tokenHash {
+			return &reset, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *MemoryRepository) ConsumePasswordReset(ctx context.Context, reset *PasswordReset, passwordHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.resets[reset.Email]
+	if !ok || stored.TokenHash != reset.TokenHash {
+		return ErrNotFound
+	}
+	user, ok := r.userByUsername(reset.Email)
+	if !ok {
+		return ErrNotFound
+	}
+
+	delete(r.resets, reset.Email)
+	user.Password = passwordHash
+	user.UpdatedAt = time.Now()
+	r.users[user.ID] = user
+	r.revokeRefreshTokens(user.ID)
+	delete(r.attempts, usernameLockoutKey(user.Username))
+	return nil
+}
+
+func (r *MemoryRepository) CreateRefreshToken(ctx context.Context, token *RefreshToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.refreshTokens[token.ID] = *token
+	return nil
+}
+
+func (r *MemoryRepository) FindRefreshToken(ctx context.Context, tokenHash string) (*RefreshToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, token := range r.refreshTokens {
+		if token.TokenHash == tokenHash {
+			return &token, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *MemoryRepository) RotateRefreshToken(ctx context.Context, current, next *RefreshToken) (*UserModel, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.refreshTokens[current.ID]
+	if !ok || stored.RevokedAt != nil {
+		return nil, ErrNotFound
+	}
+	user, ok := r.users[current.UserID]
+	if !ok || user.DeletedAt.Valid {
+		return nil, ErrNotFound
+	}
+
+	now := time.Now()
+	stored.RevokedAt = &now
+	r.refreshTokens[stored.ID] = stored
+	r.refreshTokens[next.ID] = *next
+	return &user, nil
+}
+
+func (r *MemoryRepository) RevokeRefreshTokenFamily(ctx context.Context, familyID uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for id, token := range r.refreshTokens {
+		if token.FamilyID == familyID && token.RevokedAt == nil {
+			token.RevokedAt = &now
+			r.refreshTokens[id] = token
+		}
+	}
+	return nil
+}
+
+func (r *MemoryRepository) ClaimOutboxMessages(ctx context.Context, limit int, lease time.Duration) ([]OutboxMessage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	var due []OutboxMessage
+	for _, msg := range r.outbox {
+		if msg.PublishedAt == nil && !msg.NextAttemptAt.After(now) {
+			due = append(due, msg)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].CreatedAt.Before(due[j].CreatedAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	for _, msg := range due {
+		msg.NextAttemptAt = now.Add(lease)
+		r.outbox[msg.ID] = msg
+	}
+	return due, nil
+}
+
+func (r *MemoryRepository) UpdateOutboxMessage(ctx context.Context, msg *OutboxMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stored, ok := r.outbox[msg.ID]
+	if !ok {
+		return ErrNotFound
+	}
+	stored.Attempts = msg.Attempts
+	stored.NextAttemptAt = msg.NextAttemptAt
+	stored.PublishedAt = msg.PublishedAt
+	stored.LastError = msg.LastError
+	r.outbox[msg.ID] = stored
+	return nil
+}
+
+func (r *MemoryRepository) PruneOutboxMessages(ctx context.Context, publishedBefore time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pruned := 0
+	for id, msg := range r.outbox {
+		if msg.PublishedAt != nil && msg.PublishedAt.Before(publishedBefore) {
+			delete(r.outbox, id)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// OutboxMessages returns a copy of every stored outbox message.
+func (r *MemoryRepository) OutboxMessages() []OutboxMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	out := make([]OutboxMessage, 0, len(r.outbox))
+	for _, msg := range r.outbox {
+		out = append(out, msg)
+	}
+	return out
+}
+
+// usernameHeld reports whether an account other than except, including a
+// soft-deleted one, holds username.
+func (r *MemoryRepository) usernameHeld(username string, except uuid.UUID) bool {
+	for id, user := range r.users {
+		if id != except && strings.EqualFold(user.Username, username) {
+			return true
+		}
+	}
+	return false
+}
+
+// revokeRefreshTokens revokes every active refresh token of the user, as
+// RevokeRefreshTokens does in Postgres.
+func (r *MemoryRepository) revokeRefreshTokens(userID uuid.UUID) {
+	now := time.Now()
+	for id, token := range r.refreshTokens {
+		if token.UserID == userID && token.RevokedAt == nil {
+			token.RevokedAt = &now
+			r.refreshTokens[id] = token
+		}
+	}
+}
+
+func (r *MemoryRepository) userByUsername(username string) (UserModel, bool) {
+	for _, user := range r.users {
+		if strings.EqualFold(user.Username, username) && !user.DeletedAt.Valid {
+			return user, true
+		}
+	}
+	return UserModel{}, false
+}
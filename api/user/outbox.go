@@ -0,0 +1,271 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"webapp/logger"
+	"webapp/metrics"
+	"webapp/tracing"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// OutboxMessage is a Pub/Sub message persisted in the same transaction as the
+// change that produced it. The OutboxRelay publishes pending rows and marks
+// them as published, so a message is never lost when Pub/Sub is unavailable.
+type OutboxMessage struct {
+	ID            uuid.UUID         `gorm:"type:uuid;primaryKey"`
+	CreatedAt     time.Time         `gorm:"not null"`
+	Topic         string            `gorm:"type:varchar(255);not null"`
+	Payload       []byte            `gorm:"type:bytea;not null"`
+	Attributes    map[string]string `gorm:"type:text;serializer:json"`
+	Attempts      int               `gorm:"not null;default:0"`
+	NextAttemptAt time.Time         `gorm:"not null;index"`
+	PublishedAt   *time.Time        `gorm:"index"`
+	LastError     string            `gorm:"type:text"`
+}
+
+// newOutboxMessage builds a pending outbox message for payload. The trace
+// context of ctx is saved in the message attributes, so the publish, whenever
+// it happens, continues the trace of the request that produced it.
+func newOutboxMessage(ctx context.Context, topic string, payload interface{}, attributes map[string]string) (*OutboxMessage, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	attributes = tracing.Inject(ctx, attributes)
+
+	now := time.Now()
+	return &OutboxMessage{
+		ID:            uuid.New(),
+		CreatedAt:     now,
+		Topic:         topic,
+		Payload:       data,
+		Attributes:    attributes,
+		NextAttemptAt: now,
+	}, nil
+}
+
+// publishOutboxMessage publishes msg in a producer span that continues the
+// trace saved in its attributes. The attributes sent carry the publish span,
+// so the consumer's spans become its children.
+func publishOutboxMessage(ctx context.Context, publisher Publisher, msg *OutboxMessage) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	// The producing request may be long gone when the relay publishes, so
+	// link to it through the saved trace context rather than ctx.
+	parent := tracing.Extract(context.Background(), msg.Attributes)
+	_, span := tracing.Tracer().Start(parent, msg.Topic+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemGCPPubsub,
+			semconv.MessagingDestinationName(msg.Topic),
+			attribute.String("outbox.id", msg.ID.String()),
+			attribute.Int("outbox.attempts", msg.Attempts),
+		),
+	)
+	defer span.End()
+
+	attributes := make(map[string]string, len(msg.Attributes))
+	for k, v := range msg.Attributes {
+		attributes[k] = v
+	}
+	tracing.Inject(trace.ContextWithSpan(ctx, span), attributes)
+
+	start := time.Now()
+	id, err := publisher.Publish(ctx, msg.Topic, msg.Payload, attributes)
+	metrics.ObserveSince(metrics.PublishDuration.WithLabelValues(msg.Topic), start)
+	result := "success"
+	if err != nil {
+		result = "error"
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetAttributes(semconv.MessagingMessageID(id))
+	}
+	metrics.PublishResults.WithLabelValues(msg.Topic, result).Inc()
+	return id, err
+}
+
+// OutboxRelay periodically drains pending outbox messages to a Publisher.
+// Failed publishes are retried with exponential backoff. Messages are claimed
+// for Lease before they are published, so several instances can run a relay
+// concurrently without holding row locks while Pub/Sub is slow. Published
+// messages are deleted once Retention has passed.
+type OutboxRelay struct {
+	outbox        OutboxRepository
+	Interval      time.Duration
+	BatchSize     int
+	BaseBackoff   time.Duration
+	MaxBackoff    time.Duration
+	Lease         time.Duration
+	Retention     time.Duration
+	PruneInterval time.Duration
+
+	publisher Publisher
+}
+
+func NewOutboxRelay(outbox OutboxRepository, publisher Publisher) *OutboxRelay {
+	return &OutboxRelay{
+		outbox:      outbox,
+		publisher:   publisher,
+		Interval:    2 * time.Second,
+		BatchSize:   50,
+		BaseBackoff: 5 * time.Second,
+		MaxBackoff:  5 * time.Minute,
+		// A batch publishes one message at a time with a 10 second timeout
+		// each, so the lease outlasts even a batch that times out throughout.
+		Lease:         10 * time.Minute,
+		Retention:     7 * 24 * time.Hour,
+		PruneInterval: time.Hour,
+	}
+}
+
+// Run drains the outbox and prunes published messages until ctx is
+// cancelled.
+func (r *OutboxRelay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	pruneTicker := time.NewTicker(r.PruneInterval)
+	defer pruneTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Drain(ctx); err != nil {
+				logger.Logger.Errorf("OutboxRelay.Run() - Failed to drain outbox: %v", err)
+			}
+		case <-pruneTicker.C:
+			if err := r.Prune(ctx); err != nil {
+				logger.Logger.Errorf("OutboxRelay.Run() - Failed to prune outbox: %v", err)
+			}
+		}
+	}
+}
+
+// Drain publishes the messages that are due once. The messages are claimed
+// first, then published outside any transaction, and each result is stored
+// on its own. A relay that stops midway leaves its unmarked messages to be
+// published again once their lease expires.
+func (r *OutboxRelay) Drain(ctx context.Context) error {
+	pending, err := r.outbox.ClaimOutboxMessages(ctx, r.BatchSize, r.Lease)
+	if err != nil {
+		return err
+	}
+
+	for i := range pending {
+		msg := &pending[i]
+		id, err := publishOutboxMessage(ctx, r.publisher, msg)
+		if err != nil {
+			msg.Attempts++
+			msg.LastError = err.Error()
+			msg.NextAttemptAt = time.Now().Add(r.backoff(msg.Attempts))
+			logger.Logger.WithFields(logrus.Fields{
+				"outbox_id":       msg.ID,
+				"topic":           msg.Topic,
+				"attempts":        msg.Attempts,
+				"next_attempt_at": msg.NextAttemptAt,
+			}).Errorf("OutboxRelay.Drain() - Failed to publish outbox message: %v", err)
+		} else {
+			now := time.Now()
+			msg.PublishedAt = &now
+			msg.LastError = ""
+			logger.Logger.WithFields(logrus.Fields{
+				"outbox_id":  msg.ID,
+				"topic":      msg.Topic,
+				"message_id": id,
+			}).Info("OutboxRelay.Drain() - Published outbox message")
+		}
+
+		if err := r.outbox.UpdateOutboxMessage(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prune deletes the messages published more than Retention ago.
+func (r *OutboxRelay) Prune(ctx context.Context) error {
+	pruned, err := r.outbox.PruneOutboxMessages(ctx, time.Now().Add(-r.Retention))
+	if err != nil {
+		return err
+	}
+	if pruned > 0 {
+		logger.Logger.WithField("count", pruned).Info("OutboxRelay.Prune() - Pruned published outbox messages")
+	}
+	return nil
+}
+
+// backoff returns the delay before the next attempt, doubling with each
+// failed attempt up to MaxBackoff.
+func (r *OutboxRelay) backoff(attempts int) time.Duration {
+	delay := r.BaseBackoff
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= r.MaxBackoff {
+			return r.MaxBackoff
+		}
+	}
+	return delay
+}
+
+func (r *PostgresRepository) ClaimOutboxMessages(ctx context.Context, limit int, lease time.Duration) ([]OutboxMessage, error) {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var claimed []OutboxMessage
+	err = conn.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("published_at IS NULL AND next_attempt_at <= ?", now).
+			Order("created_at").
+			Limit(limit).
+			Find(&claimed).Error
+		if err != nil || len(claimed) == 0 {
+			return err
+		}
+
+		ids := make([]uuid.UUID, len(claimed))
+		for i := range claimed {
+			ids[i] = claimed[i].ID
+		}
+		return tx.Model(&OutboxMessage{}).Where("id IN ?", ids).Update("next_attempt_at", now.Add(lease)).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+func (r *PostgresRepository) UpdateOutboxMessage(ctx context.Context, msg *OutboxMessage) error {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Model(msg).
+		Select("Attempts", "NextAttemptAt", "PublishedAt", "LastError").
+		Updates(msg).Error
+}
+
+func (r *PostgresRepository) PruneOutboxMessages(ctx context.Context, publishedBefore time.Time) (int, error) {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	result := conn.Where("published_at < ?", publishedBefore).Delete(&OutboxMessage{})
+	return int(result.RowsAffected), result.Error
+}
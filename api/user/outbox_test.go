@@ -0,0 +1,135 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingPublisher rejects every publish with err.
+type failingPublisher struct {
+	*MemoryPublisher
+	err error
+}
+
+func (p failingPublisher) Publish(ctx context.Context, topic string, data []byte, attributes map[string]string) (string, error) {
+	return "", p.err
+}
+
+func queueOutboxMessage(t *testing.T, repo *MemoryRepository) OutboxMessage {
+	t.Helper()
+	msg, err := newOutboxMessage(context.Background(), VerificationTopic, VerificationMessage{}, nil)
+	assert.NoError(t, err)
+	repo.mu.Lock()
+	repo.outbox[msg.ID] = *msg
+	repo.mu.Unlock()
+	return *msg
+}
+
+func storedOutboxMessage(repo *MemoryRepository, id uuid.UUID) OutboxMessage {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	return repo.outbox[id]
+}
+
+func TestOutboxRelayBackoffDoublesUpToMaxBackoff(t *testing.T) {
+	relay := NewOutboxRelay(NewMemoryRepository(), NewMemoryPublisher())
+	relay.BaseBackoff = time.Second
+	relay.MaxBackoff = 10 * time.Second
+
+	assert.Equal(t, time.Second, relay.backoff(1))
+	assert.Equal(t, 2*time.Second, relay.backoff(2))
+	assert.Equal(t, 4*time.Second, relay.backoff(3))
+	assert.Equal(t, 8*time.Second, relay.backoff(4))
+	assert.Equal(t, 10*time.Second, relay.backoff(5))
+	assert.Equal(t, 10*time.Second, relay.backoff(50))
+}
+
+func TestOutboxRelayDrainRecordsFailedPublish(t *testing.T) {
+	repo := NewMemoryRepository()
+	msg := queueOutboxMessage(t, repo)
+	relay := NewOutboxRelay(repo, failingPublisher{NewMemoryPublisher(), errors.New("pubsub unavailable")})
+
+	before := time.Now()
+	assert.NoError(t, relay.Drain(context.Background()))
+
+	stored := storedOutboxMessage(repo, msg.ID)
+	assert.Equal(t, 1, stored.Attempts)
+	assert.Equal(t, "pubsub unavailable", stored.LastError)
+	assert.Nil(t, stored.PublishedAt)
+	assert.False(t, stored.NextAttemptAt.Before(before.Add(relay.BaseBackoff)))
+	assert.True(t, stored.NextAttemptAt.Before(time.Now().Add(relay.Lease)), "the backoff replaces the claim lease")
+
+	// The message is not due again until its backoff has passed.
+	assert.NoError(t, relay.Drain(context.Background()))
+	assert.Equal(t, 1, storedOutboxMessage(repo, msg.ID).Attempts)
+}
+
+func TestOutboxRelayDrainMarksPublished(t *testing.T) {
+	repo := NewMemoryRepository()
+	msg := queueOutboxMessage(t, repo)
+	repo.mu.Lock()
+	failed := repo.outbox[msg.ID]
+	failed.Attempts = 2
+	failed.LastError = "pubsub unavailable"
+	repo.outbox[msg.ID] = failed
+	repo.mu.Unlock()
+	publisher := NewMemoryPublisher()
+
+	assert.NoError(t, NewOutboxRelay(repo, publisher).Drain(context.Background()))
+
+	stored := storedOutboxMessage(repo, msg.ID)
+	assert.NotNil(t, stored.PublishedAt)
+	assert.Empty(t, stored.LastError)
+	assert.Equal(t, 2, stored.Attempts)
+	assert.Len(t, publisher.Messages(), 1)
+
+	// A published message is never published again.
+	assert.NoError(t, NewOutboxRelay(repo, publisher).Drain(context.Background()))
+	assert.Len(t, publisher.Messages(), 1)
+}
+
+func TestOutboxRelayClaimHidesMessagesUntilLeaseExpires(t *testing.T) {
+	repo := NewMemoryRepository()
+	queueOutboxMessage(t, repo)
+
+	claimed, err := repo.ClaimOutboxMessages(context.Background(), 10, time.Minute)
+	assert.NoError(t, err)
+	assert.Len(t, claimed, 1)
+
+	claimed, err = repo.ClaimOutboxMessages(context.Background(), 10, time.Minute)
+	assert.NoError(t, err)
+	assert.Empty(t, claimed, "a second relay skips the leased message")
+}
+
+func TestOutboxRelayPruneDeletesOnlyOldPublishedMessages(t *testing.T) {
+	repo := NewMemoryRepository()
+	relay := NewOutboxRelay(repo, NewMemoryPublisher())
+	pending := queueOutboxMessage(t, repo)
+	recent := queueOutboxMessage(t, repo)
+	old := queueOutboxMessage(t, repo)
+
+	repo.mu.Lock()
+	for id, publishedAt := range map[uuid.UUID]time.Time{
+		recent.ID: time.Now(),
+		old.ID:    time.Now().Add(-relay.Retention - time.Hour),
+	} {
+		publishedAt := publishedAt
+		msg := repo.outbox[id]
+		msg.PublishedAt = &publishedAt
+		repo.outbox[id] = msg
+	}
+	repo.mu.Unlock()
+
+	assert.NoError(t, relay.Prune(context.Background()))
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	assert.Contains(t, repo.outbox, pending.ID)
+	assert.Contains(t, repo.outbox, recent.ID)
+	assert.NotContains(t, repo.outbox, old.ID)
+}
@@ -0,0 +1,109 @@
+package user
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"webapp/api/apierror"
+	"webapp/logger"
+)
+
+// PasswordPolicy describes what new passwords must look like. It applies at
+// signup, on /v6/user/self updates and on password reset.
+type PasswordPolicy struct {
+	// MinLength is counted in characters.
+	MinLength int
+	// MaxBytes caps the UTF-8 length. bcrypt ignores everything after 72
+	// bytes, so it must not be higher with BcryptHasher.
+	MaxBytes int
+	// MinClasses is how many of lowercase letters, uppercase letters, digits
+	// and other characters the password must mix.
+	MinClasses int
+	// Breached, when set, rejects passwords known from data breaches.
+	Breached BreachedPasswords
+}
+
+// BreachedPasswords reports whether a password appears in a breach corpus.
+type BreachedPasswords interface {
+	Contains(password string) (bool, error)
+}
+
+// PasswordRules is the policy applied to new passwords.
+var PasswordRules = PasswordPolicy{
+	MinLength:  8,
+	MaxBytes:   72,
+	MinClasses: 2,
+}
+
+// Check returns every rule password breaks, reported against field. The
+// password may not contain the username or, for usernames of at least four
+// characters, the local part of the email address. Failing to consult the
+// breach list is logged and does not reject the password.
+func (p PasswordPolicy) Check(ctx context.Context, field, password, username string) []apierror.FieldError {
+	var details []apierror.FieldError
+	reject := func(code, message string) {
+		details = append(details, apierror.FieldError{Field: field, Code: code, Message: message})
+	}
+
+	if utf8.RuneCountInString(password) < p.MinLength {
+		reject("too_short", fmt.Sprintf("%s must be at least %d characters long", field, p.MinLength))
+	}
+	if p.MaxBytes > 0 && len(password) > p.MaxBytes {
+		reject("too_long", fmt.Sprintf("%s must be at most %d bytes long", field, p.MaxBytes))
+	}
+	if characterClasses(password) < p.MinClasses {
+		reject("too_weak", fmt.Sprintf("%s must mix at least %d of lowercase letters, uppercase letters, digits and symbols", field, p.MinClasses))
+	}
+	if containsUsername(password, username) {
+		reject("contains_username", field+" must not contain the username")
+	}
+
+	if p.Breached != nil && len(details) == 0 {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			logger.FromContext(ctx).Errorf("PasswordPolicy.Check() - Failed to consult breached password list: %v", err)
+		} else if breached {
+			reject("breached", field+" appears in a known data breach, choose another one")
+		}
+	}
+	return details
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			classes++
+		}
+	}
+	return classes
+}
+
+func containsUsername(password, username string) bool {
+	password = strings.ToLower(password)
+	username = NormalizeUsername(username)
+	if username == "" {
+		return false
+	}
+	if strings.Contains(password, username) {
+		return true
+	}
+	local, _, _ := strings.Cut(username, "@")
+	return len(local) >= 4 && strings.Contains(password, local)
+}
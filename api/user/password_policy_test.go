@@ -0,0 +1,123 @@
+package user
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"webapp/api/apierror"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func detailCodes(details []apierror.FieldError) []string {
+	codes := make([]string, 0, len(details))
+	for _, d := range details {
+		codes = append(codes, d.Code)
+	}
+	return codes
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 8, MaxBytes: 72, MinClasses: 2}
+	ctx := context.Background()
+
+	assert.Empty(t, policy.Check(ctx, "password", "s3cret-password", "jane@example.com"))
+	assert.Equal(t, []string{"too_short", "too_weak"}, detailCodes(policy.Check(ctx, "password", "a", "jane@example.com")))
+	assert.Equal(t, []string{"too_long"}, detailCodes(policy.Check(ctx, "password", strings.Repeat("ab1", 25), "jane@example.com")))
+	assert.Equal(t, []string{"too_weak"}, detailCodes(policy.Check(ctx, "password", "onlyletters", "jane@example.com")))
+	assert.Equal(t, []string{"contains_username"}, detailCodes(policy.Check(ctx, "password", "Jane@Example.com", "jane@example.com")))
+	assert.Equal(t, []string{"contains_username"}, detailCodes(policy.Check(ctx, "password", "jane-2024!", "jane@example.com")))
+
+	// Multi-byte characters count once towards the minimum length.
+	assert.Empty(t, policy.Check(ctx, "password", "pässwörd1", "jane@example.com"))
+	for _, d := range policy.Check(ctx, "new_password", "a", "") {
+		assert.Equal(t, "new_password", d.Field)
+	}
+}
+
+// writeBreachedList writes the SHA-1 of passwords the way the Pwned
+// Passwords downloader does.
+func writeBreachedList(t *testing.T, passwords ...string) string {
+	lines := make([]string, 0, len(passwords))
+	for i, password := range passwords {
+		sum := sha1.Sum([]byte(password))
+		lines = append(lines, strings.ToUpper(hex.EncodeToString(sum[:]))+":"+strings.Repeat("7", i+1))
+	}
+	sort.Strings(lines)
+
+	path := filepath.Join(t.TempDir(), "pwned-passwords-sha1.txt")
+	assert.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\r\n")), 0o600))
+	return path
+}
+
+func TestBreachedList(t *testing.T) {
+	breached := []string{"password1", "qwerty123", "letmein!", "Summer2024", "iloveyou2", "trustno1!"}
+	list, err := OpenBreachedList(writeBreachedList(t, breached...))
+	assert.NoError(t, err)
+	t.Cleanup(func() { list.Close() })
+
+	for _, password := range breached {
+		found, err := list.Contains(password)
+		assert.NoError(t, err)
+		assert.True(t, found, password)
+	}
+	for _, password := range []string{"s3cret-password", "", "Password1"} {
+		found, err := list.Contains(password)
+		assert.NoError(t, err)
+		assert.False(t, found, password)
+	}
+
+	policy := PasswordPolicy{MinLength: 8, MaxBytes: 72, MinClasses: 2, Breached: list}
+	assert.Equal(t, []string{"breached"}, detailCodes(policy.Check(context.Background(), "password", "Summer2024", "jane@example.com")))
+}
+
+func TestBreachedListEmpty(t *testing.T) {
+	list, err := OpenBreachedList(writeBreachedList(t))
+	assert.NoError(t, err)
+	t.Cleanup(func() { list.Close() })
+
+	found, err := list.Contains("password1")
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestHandlersEnforcePasswordPolicy(t *testing.T) {
+	store := NewMemoryStore()
+	engine := newTestEngine(t, store, NewMemoryPublisher())
+
+	w := serve(engine, http.MethodPost, "/v6/user", map[string]string{
+		"first_name": "Jane",
+		"last_name":  "Doe",
+		"password":   "short",
+		"username":   "policy@example.com",
+	}, uuid.Nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var response apierror.Response
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, apierror.CodeValidationFailed, response.Code)
+	assert.Equal(t, []string{"too_short", "too_weak"}, detailCodes(response.Details))
+
+	id := createTestUser(t, engine, "policy@example.com")
+
+	w = serve(engine, http.MethodPatch, "/v6/user/self", map[string]string{
+		"first_name": "",
+		"password":   "policy@example.com",
+	}, id)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	response = apierror.Response{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	if assert.Len(t, response.Details, 2) {
+		assert.Equal(t, "first_name", response.Details[0].Field)
+		assert.Equal(t, "password", response.Details[1].Field)
+		assert.Equal(t, "contains_username", response.Details[1].Code)
+	}
+}
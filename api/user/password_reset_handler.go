@@ -0,0 +1,188 @@
+package user
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"webapp/api/apierror"
+	"webapp/logger"
+	"webapp/ratelimit"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PasswordResetTopic is the topic password reset messages are published to.
+var PasswordResetTopic = "password_reset"
+
+// PasswordResetTokenTTL is how long an emailed reset token stays valid.
+var PasswordResetTokenTTL = 15 * time.Minute
+
+type PasswordResetMessage struct {
+	Email      string `json:"email"`
+	ResetToken string `json:"resetToken"`
+}
+
+// PasswordReset holds the pending reset token for an email address. As with
+// EmailVerification only the token hash is stored.
+type PasswordReset struct {
+	Email      string `gorm:"primaryKey;type:varchar(100)"`
+	TokenHash  string `gorm:"type:varchar(64);uniqueIndex"`
+	ExpiryTime time.Time
+}
+
+type passwordResetRequest struct {
+	Username string `json:"username" validate:"required,email"`
+}
+
+type passwordResetConfirmation struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+// RequestPasswordResetHandler issues a reset token for a username and queues
+// a reset message. Like ResendVerificationHandler it responds with 202
+// whether or not the username exists, and shares its rate limits.
+func RequestPasswordResetHandler(store *Store) gin.HandlerFunc {
+	emailLimiter := ratelimit.New(ResendEmailLimit, ResendWindow)
+	ipLimiter := ratelimit.New(ResendIPLimit, ResendWindow)
+
+	return func(c *gin.Context) {
+		var request passwordResetRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			logger.FromContext(c).Error("RequestPasswordResetHandler() - Error in json body")
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidJSON, "Request body must be valid JSON")
+			return
+		}
+
+		request.Username = NormalizeUsername(request.Username)
+
+		if validationErr := validate.Struct(request); validationErr != nil {
+			logger.FromContext(c).Error("RequestPasswordResetHandler() - Validation Error")
+			apierror.Validation(c, validationErr)
+			return
+		}
+
+		if ok, retryAfter := ipLimiter.Allow(c.ClientIP()); !ok {
+			logger.FromContext(c).Error("RequestPasswordResetHandler() - Rate limit exceeded for client IP")
+			tooManyRequests(c, retryAfter)
+			return
+		}
+		if ok, retryAfter := emailLimiter.Allow(request.Username); !ok {
+			logger.FromContext(c).Error("RequestPasswordResetHandler() - Rate limit exceeded for email")
+			tooManyRequests(c, retryAfter)
+			return
+		}
+
+		user, err := store.Users.FindUserByUsername(c.Request.Context(), request.Username)
+		if errors.Is(err, ErrNotFound) {
+			logger.FromContext(c).Info("RequestPasswordResetHandler() - Unknown username, nothing sent")
+			c.JSON(http.StatusAccepted, gin.H{"message": "Password reset email sent if the account exists"})
+			return
+		}
+		if err != nil {
+			logger.FromContext(c).Error("RequestPasswordResetHandler() - Failed to retrieve user")
+			AbortStoreError(c, err)
+			return
+		}
+
+		token, hash, err := newToken()
+		if err != nil {
+			logger.FromContext(c).Error("RequestPasswordResetHandler() - Error generating reset token")
+			apierror.Internal(c)
+			return
+		}
+		reset := &PasswordReset{
+			Email:      user.Username,
+			TokenHash:  hash,
+			ExpiryTime: time.Now().Add(PasswordResetTokenTTL),
+		}
+		outboxMsg, err := newOutboxMessage(c.Request.Context(), PasswordResetTopic, PasswordResetMessage{
+			Email:      user.Username,
+			ResetToken: token,
+		}, map[string]string{
+			"email": user.Username,
+		})
+		if err != nil {
+			logger.FromContext(c).Error("RequestPasswordResetHandler() - Error building reset message")
+			apierror.Internal(c)
+			return
+		}
+
+		if err := store.Verifications.RequestPasswordReset(c.Request.Context(), reset, outboxMsg); err != nil {
+			logger.FromContext(c).Error("RequestPasswordResetHandler() - Failed to issue password reset")
+			AbortStoreError(c, err)
+			return
+		}
+
+		logger.FromContext(c).Info("RequestPasswordResetHandler() - Password reset email queued")
+		c.JSON(http.StatusAccepted, gin.H{"message": "Password reset email sent if the account exists"})
+		logger.FromContext(c).Debug("Completed Execution of RequestPasswordResetHandler")
+	}
+}
+
+// ConfirmPasswordResetHandler consumes a reset token and sets a new password.
+// All refresh tokens of the user are revoked.
+func ConfirmPasswordResetHandler(store *Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var request passwordResetConfirmation
+		if err := c.ShouldBindJSON(&request); err != nil {
+			logger.FromContext(c).Error("ConfirmPasswordResetHandler() - Error in json body")
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidJSON, "Request body must be valid JSON")
+			return
+		}
+
+		if validationErr := validate.Struct(request); validationErr != nil {
+			logger.FromContext(c).Error("ConfirmPasswordResetHandler() - Validation Error")
+			apierror.Validation(c, validationErr)
+			return
+		}
+
+		reset, err := store.Verifications.FindPasswordReset(c.Request.Context(), hashToken(request.Token))
+		if errors.Is(err, ErrNotFound) {
+			logger.FromContext(c).Error("ConfirmPasswordResetHandler() - Token not found")
+			apierror.Abort(c, http.StatusNotFound, apierror.CodeInvalidToken, "Token is invalid or has already been used")
+			return
+		}
+		if err != nil {
+			logger.FromContext(c).Error("ConfirmPasswordResetHandler() - Failed to look up token")
+			AbortStoreError(c, err)
+			return
+		}
+
+		if time.Now().After(reset.ExpiryTime) {
+			logger.FromContext(c).Error("ConfirmPasswordResetHandler() - Reset link expired")
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeTokenExpired, "Token has expired")
+			return
+		}
+
+		if details := PasswordRules.Check(c, "password", request.Password, reset.Email); len(details) > 0 {
+			logger.FromContext(c).Error("ConfirmPasswordResetHandler() - Password does not meet the policy")
+			apierror.AbortWithDetails(c, http.StatusBadRequest, apierror.CodeValidationFailed, "Request validation failed", details)
+			return
+		}
+
+		hashed := UserModel{Password: request.Password}
+		if err := hashed.HashPassword(); err != nil {
+			logger.FromContext(c).Error("ConfirmPasswordResetHandler() - Error hashing password")
+			apierror.Internal(c)
+			return
+		}
+
+		err = store.Verifications.ConsumePasswordReset(c.Request.Context(), reset, hashed.Password)
+		if errors.Is(err, ErrNotFound) {
+			logger.FromContext(c).Error("ConfirmPasswordResetHandler() - Token already used or user not found")
+			apierror.Abort(c, http.StatusNotFound, apierror.CodeInvalidToken, "Token is invalid or has already been used")
+			return
+		}
+		if err != nil {
+			logger.FromContext(c).Error("ConfirmPasswordResetHandler() - Failed to reset password")
+			AbortStoreError(c, err)
+			return
+		}
+
+		logger.FromContext(c).Info("ConfirmPasswordResetHandler() - Password reset successfully")
+		c.Status(http.StatusNoContent)
+		logger.FromContext(c).Debug("Completed Execution of ConfirmPasswordResetHandler")
+	}
+}
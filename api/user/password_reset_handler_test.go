@@ -0,0 +1,89 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// requestPasswordReset asks for a reset of username and returns the token
+// published for it.
+func requestPasswordReset(t *testing.T, engine *gin.Engine, publisher *MemoryPublisher, username string) string {
+	t.Helper()
+	w := serve(engine, http.MethodPost, "/v6/user/password/reset/request", map[string]string{"username": username}, uuid.Nil)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	var token string
+	for _, msg := range publisher.Messages() {
+		if msg.Topic != PasswordResetTopic {
+			continue
+		}
+		var reset PasswordResetMessage
+		assert.NoError(t, json.Unmarshal(msg.Data, &reset))
+		token = reset.ResetToken
+	}
+	assert.NotEmpty(t, token)
+	return token
+}
+
+func TestConfirmPasswordResetRevokesSessionsAndClearsLockout(t *testing.T) {
+	repo := NewMemoryRepository()
+	store := &Store{Users: repo, Verifications: repo, Lockouts: repo, Tokens: repo, Outbox: repo}
+	publisher := NewMemoryPublisher()
+	engine := newTestEngine(t, store, publisher)
+	id := createTestUser(t, engine, "jane@example.com")
+	tokens := loginForTokens(t, engine, id)
+
+	// Someone guessing passwords has locked the username out.
+	for i := 0; i < UsernameLockoutPolicy.MaxAttempts; i++ {
+		assert.NoError(t, repo.RecordLoginFailure(context.Background(), "jane@example.com", "192.0.2.1"))
+	}
+	blocked, err := repo.LoginBlockedFor(context.Background(), "jane@example.com", "198.51.100.7")
+	assert.NoError(t, err)
+	assert.Positive(t, blocked)
+
+	token := requestPasswordReset(t, engine, publisher, "jane@example.com")
+	w := serve(engine, http.MethodPost, "/v6/user/password/reset", map[string]string{"token": token, "password": "n3w-s3cret-password"}, uuid.Nil)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	assert.True(t, ValidateCredentials(context.Background(), repo, "jane@example.com", "n3w-s3cret-password"))
+	assert.False(t, ValidateCredentials(context.Background(), repo, "jane@example.com", "s3cret-password"))
+	status, _ := refresh(t, engine, tokens.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, status)
+	blocked, err = repo.LoginBlockedFor(context.Background(), "jane@example.com", "198.51.100.7")
+	assert.NoError(t, err)
+	assert.Zero(t, blocked)
+
+	// The token only works once.
+	w = serve(engine, http.MethodPost, "/v6/user/password/reset", map[string]string{"token": token, "password": "an0ther-s3cret-password"}, uuid.Nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "invalid_token", decodeError(t, w).Code)
+	assert.True(t, ValidateCredentials(context.Background(), repo, "jane@example.com", "n3w-s3cret-password"))
+}
+
+func TestConfirmPasswordResetRejectsUnknownAndExpiredTokens(t *testing.T) {
+	ttl := PasswordResetTokenTTL
+	t.Cleanup(func() { PasswordResetTokenTTL = ttl })
+
+	repo := NewMemoryRepository()
+	publisher := NewMemoryPublisher()
+	engine := newTestEngine(t, &Store{Users: repo, Verifications: repo, Lockouts: repo, Tokens: repo, Outbox: repo}, publisher)
+	createTestUser(t, engine, "jane@example.com")
+
+	w := serve(engine, http.MethodPost, "/v6/user/password/reset", map[string]string{"token": "unknown", "password": "n3w-s3cret-password"}, uuid.Nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "invalid_token", decodeError(t, w).Code)
+
+	PasswordResetTokenTTL = -time.Second
+	token := requestPasswordReset(t, engine, publisher, "jane@example.com")
+	w = serve(engine, http.MethodPost, "/v6/user/password/reset", map[string]string{"token": token, "password": "n3w-s3cret-password"}, uuid.Nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "token_expired", decodeError(t, w).Code)
+	assert.True(t, ValidateCredentials(context.Background(), repo, "jane@example.com", "s3cret-password"))
+}
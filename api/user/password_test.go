@@ -0,0 +1,102 @@
+package user
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// fastArgon2id keeps tests quick; production parameters come from config.
+var fastArgon2id = Argon2idHasher{Memory: 64, Iterations: 1, Parallelism: 1}
+
+func TestArgon2idHasher(t *testing.T) {
+	encoded, err := fastArgon2id.Hash("correct horse")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$"))
+
+	assert.NoError(t, ComparePassword(encoded, "correct horse"))
+	assert.ErrorIs(t, ComparePassword(encoded, "wrong horse"), ErrPasswordMismatch)
+
+	assert.False(t, fastArgon2id.NeedsRehash(encoded))
+	assert.True(t, Argon2idHasher{Memory: 128, Iterations: 1, Parallelism: 1}.NeedsRehash(encoded))
+	assert.True(t, BcryptHasher{Cost: bcrypt.MinCost}.NeedsRehash(encoded))
+}
+
+func TestBcryptHasher(t *testing.T) {
+	hasher := BcryptHasher{Cost: bcrypt.MinCost}
+	encoded, err := hasher.Hash("correct horse")
+	assert.NoError(t, err)
+
+	assert.NoError(t, ComparePassword(encoded, "correct horse"))
+	assert.ErrorIs(t, ComparePassword(encoded, "wrong horse"), ErrPasswordMismatch)
+
+	assert.False(t, hasher.NeedsRehash(encoded))
+	assert.True(t, BcryptHasher{Cost: bcrypt.MinCost + 1}.NeedsRehash(encoded))
+	assert.True(t, fastArgon2id.NeedsRehash(encoded))
+}
+
+func TestComparePasswordRejectsUnknownHashes(t *testing.T) {
+	assert.ErrorIs(t, ComparePassword("plaintext", "plaintext"), ErrUnknownHash)
+	assert.Error(t, ComparePassword("$argon2id$v=19$m=64,t=0,p=1$c2FsdA$a2V5", "password"))
+}
+
+func TestValidateCredentialsUpgradesOutdatedHash(t *testing.T) {
+	hasher := Hasher
+	t.Cleanup(func() { Hasher = hasher })
+
+	legacy, err := BcryptHasher{Cost: bcrypt.MinCost}.Hash("correct horse")
+	assert.NoError(t, err)
+
+	repo := NewMemoryRepository()
+	user := UserModel{ID: uuid.New(), Username: "upgrade@example.com", Password: legacy}
+	assert.NoError(t, repo.CreateUser(context.Background(), &user, &EmailVerification{Email: user.Username}, &OutboxMessage{ID: uuid.New()}))
+
+	Hasher = fastArgon2id
+	assert.False(t, ValidateCredentials(context.Background(), repo, user.Username, "wrong horse"))
+	stored, _ := repo.FindUserByID(context.Background(), user.ID)
+	assert.Equal(t, legacy, stored.Password, "a failed login must not rehash")
+
+	assert.True(t, ValidateCredentials(context.Background(), repo, user.Username, "correct horse"))
+	stored, _ = repo.FindUserByID(context.Background(), user.ID)
+	assert.True(t, strings.HasPrefix(stored.Password, "$argon2id$"))
+	assert.False(t, Hasher.NeedsRehash(stored.Password))
+
+	assert.True(t, ValidateCredentials(context.Background(), repo, user.Username, "correct horse"))
+}
+
+// passwordChangingUsers changes the stored password between the credential
+// check and the rehash, as a concurrent password reset would.
+type passwordChangingUsers struct {
+	*MemoryRepository
+	newHash string
+}
+
+func (u passwordChangingUsers) ReplacePasswordHash(ctx context.Context, id uuid.UUID, oldHash, newHash string) (bool, error) {
+	if err := u.UpdateUser(ctx, id, UserModel{Password: u.newHash}); err != nil {
+		return false, err
+	}
+	return u.MemoryRepository.ReplacePasswordHash(ctx, id, oldHash, newHash)
+}
+
+func TestValidateCredentialsKeepsConcurrentPasswordChange(t *testing.T) {
+	hasher := Hasher
+	t.Cleanup(func() { Hasher = hasher })
+
+	legacy, err := BcryptHasher{Cost: bcrypt.MinCost}.Hash("old horse")
+	assert.NoError(t, err)
+	changed, err := fastArgon2id.Hash("new horse")
+	assert.NoError(t, err)
+
+	repo := NewMemoryRepository()
+	user := UserModel{ID: uuid.New(), Username: "race@example.com", Password: legacy}
+	assert.NoError(t, repo.CreateUser(context.Background(), &user, &EmailVerification{Email: user.Username}, &OutboxMessage{ID: uuid.New()}))
+
+	Hasher = fastArgon2id
+	assert.True(t, ValidateCredentials(context.Background(), passwordChangingUsers{repo, changed}, user.Username, "old horse"))
+	stored, _ := repo.FindUserByID(context.Background(), user.ID)
+	assert.Equal(t, changed, stored.Password)
+}
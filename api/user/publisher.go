@@ -0,0 +1,196 @@
+package user
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/google/uuid"
+)
+
+// Publisher delivers messages to a named topic. Implementations must be safe
+// for concurrent use.
+type Publisher interface {
+	Publish(ctx context.Context, topic string, data []byte, attributes map[string]string) (string, error)
+	// Ping reports whether the backend is currently reachable.
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// PubSubPublisher publishes to Google Cloud Pub/Sub through a single
+// long-lived client.
+type PubSubPublisher struct {
+	client *pubsub.Client
+
+	mu     sync.Mutex
+	topics map[string]*pubsub.Topic
+}
+
+func NewPubSubPublisher(ctx context.Context, projectID string) (*PubSubPublisher, error) {
+	client, err := pubsub.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	return &PubSubPublisher{client: client, topics: make(map[string]*pubsub.Topic)}, nil
+}
+
+func (p *PubSubPublisher) topic(name string) *pubsub.Topic {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t, ok := p.topics[name]
+	if !ok {
+		t = p.client.Topic(name)
+		p.topics[name] = t
+	}
+	return t
+}
+
+func (p *PubSubPublisher) Publish(ctx context.Context, topic string, data []byte, attributes map[string]string) (string, error) {
+	result := p.topic(topic).Publish(ctx, &pubsub.Message{
+		Data:       data,
+		Attributes: attributes,
+	})
+	return result.Get(ctx)
+}
+
+// Ping looks up the verification topic, which needs a working connection to
+// Pub/Sub and permission to see the topic.
+func (p *PubSubPublisher) Ping(ctx context.Context) error {
+	exists, err := p.topic(VerificationTopic).Exists(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("topic %q does not exist", VerificationTopic)
+	}
+	return nil
+}
+
+func (p *PubSubPublisher) Close() error {
+	p.mu.Lock()
+	for _, t := range p.topics {
+		t.Stop()
+	}
+	p.mu.Unlock()
+	return p.client.Close()
+}
+
+// PublishedMessage is a message recorded by MemoryPublisher.
+type PublishedMessage struct {
+	ID         string
+	Topic      string
+	Data       []byte
+	Attributes map[string]string
+}
+
+// MemoryPublisher records published messages in memory. It is intended for
+// tests.
+type MemoryPublisher struct {
+	mu       sync.Mutex
+	messages []PublishedMessage
+}
+
+func NewMemoryPublisher() *MemoryPublisher {
+	return &MemoryPublisher{}
+}
+
+func (p *MemoryPublisher) Publish(ctx context.Context, topic string, data []byte, attributes map[string]string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	id := strconv.Itoa(len(p.messages) + 1)
+	p.messages = append(p.messages, PublishedMessage{
+		ID:         id,
+		Topic:      topic,
+		Data:       append([]byte(nil), data...),
+		Attributes: attributes,
+	})
+	return id, nil
+}
+
+func (p *MemoryPublisher) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (p *MemoryPublisher) Close() error {
+	return nil
+}
+
+// Messages returns a copy of every message published so far.
+func (p *MemoryPublisher) Messages() []PublishedMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]PublishedMessage(nil), p.messages...)
+}
+
+// VerificationMessages decodes the recorded messages published to topic.
+func (p *MemoryPublisher) VerificationMessages(topic string) []VerificationMessage {
+	var out []VerificationMessage
+	for _, m := range p.Messages() {
+		if m.Topic != topic {
+			continue
+		}
+		var vMessage VerificationMessage
+		if err := json.Unmarshal(m.Data, &vMessage); err == nil {
+			out = append(out, vMessage)
+		}
+	}
+	return out
+}
+
+// FilePublisher appends each message as a JSON line to a local file. It is
+// intended for local development without Pub/Sub credentials.
+type FilePublisher struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+type fileRecord struct {
+	ID          string            `json:"id"`
+	Topic       string            `json:"topic"`
+	PublishedAt time.Time         `json:"published_at"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	Data        json.RawMessage   `json:"data"`
+}
+
+func NewFilePublisher(path string) (*FilePublisher, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FilePublisher{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+func (p *FilePublisher) Publish(ctx context.Context, topic string, data []byte, attributes map[string]string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	record := fileRecord{
+		ID:          uuid.NewString(),
+		Topic:       topic,
+		PublishedAt: time.Now().UTC(),
+		Attributes:  attributes,
+		Data:        data,
+	}
+	if !json.Valid(data) {
+		encoded, _ := json.Marshal(string(data))
+		record.Data = encoded
+	}
+	if err := p.enc.Encode(record); err != nil {
+		return "", err
+	}
+	return record.ID, nil
+}
+
+func (p *FilePublisher) Ping(ctx context.Context) error {
+	_, err := p.file.Stat()
+	return err
+}
+
+func (p *FilePublisher) Close() error {
+	return p.file.Close()
+}
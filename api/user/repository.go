@@ -0,0 +1,618 @@
+package user
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"webapp/api/apierror"
+	"webapp/db"
+	"webapp/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrNotFound is returned by repositories when no matching record exists.
+	ErrNotFound = errors.New("record not found")
+	// ErrUsernameTaken is returned when storing a username that another
+	// account, possibly soft-deleted, already holds.
+	ErrUsernameTaken = errors.New("username already taken")
+)
+
+// UserRepository stores user accounts. Usernames are compared
+// case-insensitively and lookups ignore soft-deleted accounts unless stated
+// otherwise.
+type UserRepository interface {
+	// CreateUser stores user together with its pending email verification
+	// and the outbox message carrying the verification token, atomically. It
+	// returns ErrUsernameTaken when the username is in use.
+	CreateUser(ctx context.Context, user *UserModel, verification *EmailVerification, msg *OutboxMessage) error
+	// UsernameExists reports whether username is taken, including by a
+	// soft-deleted account whose grace period has not yet expired.
+	UsernameExists(ctx context.Context, username string) (bool, error)
+	FindUserByUsername(ctx context.Context, username string) (*UserModel, error)
+	FindUserByID(ctx context.Context, id uuid.UUID) (*UserModel, error)
+	// UpdateUser sets the non-empty FirstName, LastName, Password and
+	// Username of changes on the user with the given ID. A new password also
+	// revokes the user's refresh tokens in the same step. It returns
+	// ErrUsernameTaken when the new username is in use.
+	UpdateUser(ctx context.Context, id uuid.UUID, changes UserModel) error
+	// ReplacePasswordHash sets the password hash of the user to newHash only
+	// while it is still oldHash, and reports whether it did. A password
+	// changed in the meantime is left alone.
+	ReplacePasswordHash(ctx context.Context, id uuid.UUID, oldHash, newHash string) (bool, error)
+	// DeleteUser soft-deletes the user and in the same step removes its
+	// pending verification, password reset and email change and revokes its
+	// refresh tokens. It returns ErrNotFound when the user is already gone.
+	DeleteUser(ctx context.Context, id uuid.UUID) error
+	// PurgeDeletedUsers permanently removes the accounts soft-deleted before
+	// cutoff, together with their refresh tokens, pending tokens and login
+	// failures, and returns how many it removed.
+	PurgeDeletedUsers(ctx context.Context, cutoff time.Time) (int, error)
+}
+
+// VerificationRepository stores pending email verifications, email changes
+// and password resets.
+type VerificationRepository interface {
+	// RotateVerification replaces the pending verification of
+	// verification.Email, together with the outbox message carrying the new
+	// token.
+	RotateVerification(ctx context.Context, verification *EmailVerification, msg *OutboxMessage) error
+	FindVerification(ctx context.Context, tokenHash string) (*EmailVerification, error)
+	// ConsumeVerification deletes the verification and marks its user as
+	// verified in one step, so a token can only ever be used once. It returns
+	// ErrNotFound when the token was already used or the user is gone.
+	ConsumeVerification(ctx context.Context, verification *EmailVerification) error
+
+	// RequestEmailChange stores change, replacing any pending change of the
+	// same user, together with the outbox message carrying its token.
+	RequestEmailChange(ctx context.Context, change *EmailChange, msg *OutboxMessage) error
+	FindEmailChange(ctx context.Context, tokenHash string) (*EmailChange, error)
+	// ConsumeEmailChange deletes the change and sets the user's username to
+	// the new email in one step. Confirming proves ownership of the new
+	// address, so the user is marked verified. Pending verifications, password
+	// resets and login failures of the old address are removed. It returns
+	// ErrNotFound when the token was already used or the user is gone, and
+	// ErrUsernameTaken when another account claimed the address in the
+	// meantime.
+	ConsumeEmailChange(ctx context.Context, change *EmailChange) error
+
+	// RequestPasswordReset stores reset, replacing any pending reset of the
+	// same email, together with the outbox message carrying its token.
+	RequestPasswordReset(ctx context.Context, reset *PasswordReset, msg *OutboxMessage) error
+	FindPasswordReset(ctx context.Context, tokenHash string) (*PasswordReset, error)
+	// ConsumePasswordReset deletes the reset, sets the password hash of its
+	// user, revokes the user's refresh tokens and clears the username's login
+	// failures in one step. It returns ErrNotFound when the token was already
+	// used or the user is gone.
+	ConsumePasswordReset(ctx context.Context, reset *PasswordReset, passwordHash string) error
+}
+
+// TokenRepository stores refresh tokens.
+type TokenRepository interface {
+	CreateRefreshToken(ctx context.Context, token *RefreshToken) error
+	FindRefreshToken(ctx context.Context, tokenHash string) (*RefreshToken, error)
+	// RotateRefreshToken revokes current and stores next, of the same
+	// family, in one step and returns their user. It returns ErrNotFound
+	// when current was revoked in the meantime or the user is gone, so two
+	// concurrent refreshes of one token cannot both succeed.
+	RotateRefreshToken(ctx context.Context, current, next *RefreshToken) (*UserModel, error)
+	// RevokeRefreshTokenFamily revokes every active token of the family.
+	RevokeRefreshTokenFamily(ctx context.Context, familyID uuid.UUID) error
+}
+
+// LockoutRepository counts failed logins per username and client IP and
+// blocks them according to UsernameLockoutPolicy and IPLockoutPolicy.
+type LockoutRepository interface {
+	// LoginBlockedFor reports how long login attempts for username from ip
+	// must wait. Zero means the attempt may proceed.
+	LoginBlockedFor(ctx context.Context, username, ip string) (time.Duration, error)
+	// RecordLoginFailure counts a failed login against both username and ip.
+	RecordLoginFailure(ctx context.Context, username, ip string) error
+	// RecordLoginSuccess clears the failure count of username. The IP count
+	// is left to expire so one valid account can't be used to reset it.
+	RecordLoginSuccess(ctx context.Context, username string) error
+	// PruneLoginAttempts deletes the failure counts that are past their
+	// policy's ResetAfter and no longer blocked at now, and returns how many
+	// it deleted.
+	PruneLoginAttempts(ctx context.Context, now time.Time) (int, error)
+}
+
+// OutboxRepository hands pending outbox messages to the OutboxRelay.
+type OutboxRepository interface {
+	// ClaimOutboxMessages returns up to limit unpublished messages that are
+	// due, oldest first, and moves their next attempt lease into the future
+	// so other relays skip them meanwhile.
+	ClaimOutboxMessages(ctx context.Context, limit int, lease time.Duration) ([]OutboxMessage, error)
+	// UpdateOutboxMessage stores the Attempts, NextAttemptAt, PublishedAt
+	// and LastError of msg.
+	UpdateOutboxMessage(ctx context.Context, msg *OutboxMessage) error
+	// PruneOutboxMessages deletes the messages published before
+	// publishedBefore and returns how many it deleted.
+	PruneOutboxMessages(ctx context.Context, publishedBefore time.Time) (int, error)
+}
+
+// Store bundles the repositories used by the handlers and background jobs.
+type Store struct {
+	Users         UserRepository
+	Verifications VerificationRepository
+	Lockouts      LockoutRepository
+	Tokens        TokenRepository
+	Outbox        OutboxRepository
+}
+
+// NewPostgresStore returns a Store backed by the database of provider.
+func NewPostgresStore(database *db.Provider) *Store {
+	repo := NewPostgresRepository(database)
+	return &Store{Users: repo, Verifications: repo, Lockouts: repo, Tokens: repo, Outbox: repo}
+}
+
+// AbortStoreError answers a failed repository call: 503 while the database
+// is unavailable, 404 when the record is gone, 409 when a username is
+// already taken, 500 otherwise.
+func AbortStoreError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, db.ErrUnavailable):
+		apierror.Abort(c, http.StatusServiceUnavailable, apierror.CodeServiceUnavailable, "Database is unavailable")
+	case errors.Is(err, ErrNotFound):
+		apierror.Abort(c, http.StatusNotFound, apierror.CodeNotFound, "User not found")
+	case errors.Is(err, ErrUsernameTaken):
+		emailExists(c)
+	default:
+		apierror.Internal(c)
+	}
+}
+
+// PostgresRepository implements the repositories with GORM. Every call uses
+// the provider's current connection and fails with db.ErrUnavailable while
+// there is none.
+type PostgresRepository struct {
+	database *db.Provider
+}
+
+func NewPostgresRepository(database *db.Provider) *PostgresRepository {
+	return &PostgresRepository{database: database}
+}
+
+func (r *PostgresRepository) conn(ctx context.Context) (*gorm.DB, error) {
+	conn, err := r.database.DB()
+	if err != nil {
+		logger.FromContext(ctx).Error("PostgresRepository.conn() - Database unavailable")
+		return nil, err
+	}
+	return conn.WithContext(ctx), nil
+}
+
+func (r *PostgresRepository) CreateUser(ctx context.Context, user *UserModel, verification *EmailVerification, msg *OutboxMessage) error {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return usernameTaken(err)
+		}
+		if err := saveEmailVerification(tx, verification); err != nil {
+			return err
+		}
+		return tx.Create(msg).Error
+	})
+}
+
+func (r *PostgresRepository) UsernameExists(ctx context.Context, username string) (bool, error) {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	var count int64
+	err = conn.Unscoped().Model(&UserModel{}).Where("lower(username) = lower(?)", username).Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (r *PostgresRepository) FindUserByUsername(ctx context.Context, username string) (*UserModel, error) {
+	return r.findUser(ctx, "lower(username) = lower(?)", username)
+}
+
+func (r *PostgresRepository) FindUserByID(ctx context.Context, id uuid.UUID) (*UserModel, error) {
+	return r.findUser(ctx, "id = ?", id)
+}
+
+func (r *PostgresRepository) findUser(ctx context.Context, query string, arg interface{}) (*UserModel, error) {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var user UserModel
+	if err := conn.Where(query, arg).First(&user).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &user, nil
+}
+
+func (r *PostgresRepository) UpdateUser(ctx context.Context, id uuid.UUID, changes UserModel) error {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Transaction(func(tx *gorm.DB) error {
+		// Updates with a struct skips zero fields, so only what was provided
+		// is written.
+		result := tx.Model(&UserModel{}).Where("id = ?", id).Updates(UserModel{
+			FirstName: changes.FirstName,
+			LastName:  changes.LastName,
+			Password:  changes.Password,
+			Username:  changes.Username,
+		})
+		if result.Error != nil {
+			return usernameTaken(result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		if changes.Password == "" {
+			return nil
+		}
+		// Whoever holds a stolen refresh token must not outlive the change.
+		return RevokeRefreshTokens(tx, id)
+	})
+}
+
+func (r *PostgresRepository) ReplacePasswordHash(ctx context.Context, id uuid.UUID, oldHash, newHash string) (bool, error) {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	// UpdateColumn leaves updated_at alone; the password did not change.
+	result := conn.Model(&UserModel{}).Where("id = ? AND password = ?", id, oldHash).UpdateColumn("password", newHash)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (r *PostgresRepository) RotateVerification(ctx context.Context, verification *EmailVerification, msg *OutboxMessage) error {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Transaction(func(tx *gorm.DB) error {
+		if err := saveEmailVerification(tx, verification); err != nil {
+			return err
+		}
+		return tx.Create(msg).Error
+	})
+}
+
+func (r *PostgresRepository) DeleteUser(ctx context.Context, id uuid.UUID) error {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Transaction(func(tx *gorm.DB) error {
+		var user UserModel
+		if err := tx.First(&user, "id = ?", id).Error; err != nil {
+			return notFound(err)
+		}
+		if err := tx.Where("email = ?", user.Username).Delete(&EmailVerification{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("email = ?", user.Username).Delete(&PasswordReset{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&EmailChange{}).Error; err != nil {
+			return err
+		}
+		if err := RevokeRefreshTokens(tx, user.ID); err != nil {
+			return err
+		}
+		result := tx.Delete(&user)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (r *PostgresRepository) PurgeDeletedUsers(ctx context.Context, cutoff time.Time) (int, error) {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var expired []UserModel
+	err = conn.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().
+			Where("deleted_at IS NOT NULL AND deleted_at < ?", cutoff).
+			Find(&expired).Error
+		if err != nil || len(expired) == 0 {
+			return err
+		}
+
+		ids := make([]uuid.UUID, 0, len(expired))
+		usernames := make([]string, 0, len(expired))
+		lockoutKeys := make([]string, 0, len(expired))
+		for _, user := range expired {
+			ids = append(ids, user.ID)
+			usernames = append(usernames, user.Username)
+			lockoutKeys = append(lockoutKeys, usernameLockoutKey(user.Username))
+		}
+
+		if err := tx.Where("user_id IN ?", ids).Delete(&RefreshToken{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("email IN ?", usernames).Delete(&EmailVerification{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("email IN ?", usernames).Delete(&PasswordReset{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id IN ?", ids).Delete(&EmailChange{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("key IN ?", lockoutKeys).Delete(&LoginAttempt{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("id IN ?", ids).Delete(&UserModel{}).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(expired), nil
+}
+
+func (r *PostgresRepository) FindVerification(ctx context.Context, tokenHash string) (*EmailVerification, error) {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var verification EmailVerification
+	if err := conn.Where("token_hash = ?", tokenHash).First(&verification).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &verification, nil
+}
+
+func (r *PostgresRepository) ConsumeVerification(ctx context.Context, verification *EmailVerification) error {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("email = ? AND token_hash = ?", verification.Email, verification.TokenHash).
+			Delete(&EmailVerification{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotFound
+		}
+
+		result = tx.Model(&UserModel{}).Where("username = ?", verification.Email).Update("is_verified", true)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (r *PostgresRepository) RequestEmailChange(ctx context.Context, change *EmailChange, msg *OutboxMessage) error {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"new_email", "token_hash", "expiry_time"}),
+		}).Create(change).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(msg).Error
+	})
+}
+
+func (r *PostgresRepository) FindEmailChange(ctx context.Context, tokenHash string) (*EmailChange, error) {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var change EmailChange
+	if err := conn.Where("token_hash = ?", tokenHash).First(&change).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &change, nil
+}
+
+func (r *PostgresRepository) ConsumeEmailChange(ctx context.Context, change *EmailChange) error {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("user_id = ? AND token_hash = ?", change.UserID, change.TokenHash).Delete(&EmailChange{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotFound
+		}
+
+		var user UserModel
+		if err := tx.First(&user, "id = ?", change.UserID).Error; err != nil {
+			return notFound(err)
+		}
+		oldEmail := user.Username
+		err := tx.Model(&user).Updates(map[string]interface{}{
+			"username":    change.NewEmail,
+			"is_verified": true,
+		}).Error
+		if err != nil {
+			return usernameTaken(err)
+		}
+
+		// Drop what is keyed by the old address; nothing would match it again.
+		if err := tx.Where("email = ?", oldEmail).Delete(&EmailVerification{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("email = ?", oldEmail).Delete(&PasswordReset{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("key = ?", usernameLockoutKey(oldEmail)).Delete(&LoginAttempt{}).Error
+	})
+}
+
+func (r *PostgresRepository) RequestPasswordReset(ctx context.Context, reset *PasswordReset, msg *OutboxMessage) error {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "email"}},
+			DoUpdates: clause.AssignmentColumns([]string{"token_hash", "expiry_time"}),
+		}).Create(reset).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(msg).Error
+	})
+}
+
+func (r *PostgresRepository) FindPasswordReset(ctx context.Context, tokenHash string) (*PasswordReset, error) {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var reset PasswordReset
+	if err := conn.Where("token_hash = ?", tokenHash).First(&reset).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &reset, nil
+}
+
+func (r *PostgresRepository) ConsumePasswordReset(ctx context.Context, reset *PasswordReset, passwordHash string) error {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("email = ? AND token_hash = ?", reset.Email, reset.TokenHash).Delete(&PasswordReset{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotFound
+		}
+
+		var user UserModel
+		if err := tx.Where("username = ?", reset.Email).First(&user).Error; err != nil {
+			return notFound(err)
+		}
+		if err := tx.Model(&user).Update("password", passwordHash).Error; err != nil {
+			return err
+		}
+		if err := RevokeRefreshTokens(tx, user.ID); err != nil {
+			return err
+		}
+		// The owner just proved control of the address, so a lockout left by
+		// someone guessing the old password must not keep them out.
+		return tx.Where("key = ?", usernameLockoutKey(user.Username)).Delete(&LoginAttempt{}).Error
+	})
+}
+
+func (r *PostgresRepository) CreateRefreshToken(ctx context.Context, token *RefreshToken) error {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Create(token).Error
+}
+
+func (r *PostgresRepository) FindRefreshToken(ctx context.Context, tokenHash string) (*RefreshToken, error) {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var token RefreshToken
+	if err := conn.Where("token_hash = ?", tokenHash).First(&token).Error; err != nil {
+		return nil, notFound(err)
+	}
+	return &token, nil
+}
+
+func (r *PostgresRepository) RotateRefreshToken(ctx context.Context, current, next *RefreshToken) (*UserModel, error) {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var user UserModel
+	err = conn.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&RefreshToken{}).
+			Where("id = ? AND revoked_at IS NULL", current.ID).
+			Update("revoked_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		if err := tx.First(&user, "id = ?", current.UserID).Error; err != nil {
+			return notFound(err)
+		}
+		return tx.Create(next).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *PostgresRepository) RevokeRefreshTokenFamily(ctx context.Context, familyID uuid.UUID) error {
+	conn, err := r.conn(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Model(&RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// saveEmailVerification creates the verification or replaces the pending one
+// for the same email.
+func saveEmailVerification(tx *gorm.DB, verification *EmailVerification) error {
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "email"}},
+		DoUpdates: clause.AssignmentColumns([]string{"token_hash", "expiry_time"}),
+	}).Create(verification).Error
+}
+
+// usernameTaken translates the unique violation of idx_user_models_username
+// to ErrUsernameTaken. It is the only unique constraint a user row can break.
+func usernameTaken(err error) error {
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return ErrUsernameTaken
+	}
+	return err
+}
+
+// notFound translates gorm.ErrRecordNotFound to ErrNotFound.
+func notFound(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
@@ -2,26 +2,30 @@ package user
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"net/http"
-	"os"
+	"sort"
 	"strings"
 	"time"
 
+	"webapp/api/apierror"
 	"webapp/logger"
+	"webapp/metrics"
 
 	"github.com/gin-gonic/gin"
-	"github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
-
-	"cloud.google.com/go/pubsub"
 )
 
-var projectID = "csye6225-dev-414220"
-var topicName = "verify_email"
+// validate checks request bodies and reports fields by their JSON name.
+var validate = apierror.NewValidator()
+
+// VerificationTopic is the topic verification messages are published to.
+var VerificationTopic = "verify_email"
+
+// VerificationTokenTTL is how long an emailed verification token stays valid.
+var VerificationTokenTTL = 2 * time.Minute
 
 type UserModel struct {
 	ID         uuid.UUID `gorm:"type:uuid;primaryKey" json:"-"`
@@ -32,68 +36,104 @@ type UserModel struct {
 	Password   string    `json:"password" validate:"required" writeOnly:"true"`
 	Username   string    `json:"username" validate:"required,email"`
 	IsVerified bool      `json:"is_verified" gorm:"default:false"`
+	// DeletedAt marks a soft-deleted account, see DeleteUserHandler.
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
 type VerificationMessage struct {
-	Email             string    `json:"email"`
-	VerificationToken uuid.UUID `json:"verificationToken"`
+	Email             string `json:"email"`
+	VerificationToken string `json:"verificationToken"`
 }
 
+// EmailVerification holds the pending verification token for an email
+// address. Only the token hash is stored; the token itself is only ever sent
+// to the user.
 type EmailVerification struct {
-	Email      string    `gorm:"primaryKey;type:varchar(100)"`
-	UUID       uuid.UUID `gorm:"type:uuid;unique"`
+	Email      string `gorm:"primaryKey;type:varchar(100)"`
+	TokenHash  string `gorm:"type:varchar(64);uniqueIndex"`
 	ExpiryTime time.Time
 }
 
-// HashPassword hashes the user's password.
+// NormalizeUsername trims and lowercases a username. Usernames are email
+// addresses and unique regardless of case, see migration 0003.
+func NormalizeUsername(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// newEmailVerification returns a verification for email and its token.
+func newEmailVerification(email string) (*EmailVerification, string, error) {
+	token, hash, err := newToken()
+	if err != nil {
+		return nil, "", err
+	}
+	return &EmailVerification{
+		Email:      email,
+		TokenHash:  hash,
+		ExpiryTime: time.Now().Add(VerificationTokenTTL),
+	}, token, nil
+}
+
+// HashPassword replaces the user's password with its hash from Hasher.
 func (u *UserModel) HashPassword() error {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(u.Password), 14)
+	defer metrics.ObserveSince(metrics.PasswordHashDuration.WithLabelValues("hash"), time.Now())
+	hash, err := Hasher.Hash(u.Password)
 	if err != nil {
 		return err
 	}
-	u.Password = string(bytes)
+	u.Password = hash
 	return nil
 }
 
-func CreateUserHandler(db *gorm.DB) gin.HandlerFunc {
+func CreateUserHandler(store *Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var user UserModel
 		if err := c.ShouldBindJSON(&user); err != nil {
 			// fmt.Println("CreateUserHandler() - Error in json body")
-			logger.Logger.Error("CreateUserHandler() - Error in json body")
-			c.Status(http.StatusBadRequest)
+			logger.FromContext(c).Error("CreateUserHandler() - Error in json body")
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidJSON, "Request body must be valid JSON")
 			return
 		}
 
-		var validate = validator.New()
+		user.Username = NormalizeUsername(user.Username)
+
 		if validationErr := validate.Struct(user); validationErr != nil {
 			// fmt.Println("CreateUserHandler() - Validation Error:", validationErr.Error())
-			logger.Logger.Error("CreateUserHandler() - Validation Error")
-			c.Status(http.StatusBadRequest)
+			logger.FromContext(c).Error("CreateUserHandler() - Validation Error")
+			apierror.Validation(c, validationErr)
 			return
 		}
 
 		user.ID = uuid.New()
 		user.IsVerified = false
 
-		var verMsg VerificationMessage
-		// user.VerificationToken = user.ID
-		verMsg.VerificationToken = user.ID
-
 		if strings.Contains(user.Username, ":") {
 			// fmt.Println("CreateUserHandler() -Error: Username cannot contain ':' ")
-			logger.Logger.Error("CreateUserHandler() - Username cannot contain ':'")
-			c.Status(http.StatusBadRequest)
+			logger.FromContext(c).Error("CreateUserHandler() - Username cannot contain ':'")
+			apierror.AbortWithDetails(c, http.StatusBadRequest, apierror.CodeValidationFailed, "Request validation failed", []apierror.FieldError{
+				{Field: "username", Code: "no_colon", Message: "username cannot contain ':'"},
+			})
 			return
 		}
 
-		// Check for existing email
-		var count int64
-		db.Model(&UserModel{}).Where("username = ?", user.Username).Count(&count)
-		if count > 0 {
+		if details := PasswordRules.Check(c, "password", user.Password, user.Username); len(details) > 0 {
+			logger.FromContext(c).Error("CreateUserHandler() - Password does not meet the policy")
+			apierror.AbortWithDetails(c, http.StatusBadRequest, apierror.CodeValidationFailed, "Request validation failed", details)
+			return
+		}
+
+		// Check for existing email, including soft-deleted accounts whose
+		// grace period has not yet expired, before spending time on hashing.
+		// The unique index on username settles concurrent signups.
+		exists, err := store.Users.UsernameExists(c.Request.Context(), user.Username)
+		if err != nil {
+			logger.FromContext(c).Error("CreateUserHandler() - Failed to check for existing email")
+			AbortStoreError(c, err)
+			return
+		}
+		if exists {
 			// fmt.Println("CreateUserHandler() - Error: Email-id already exists")
-			logger.Logger.Error("CreateUserHandler() - Email-id already exists")
-			c.Status(http.StatusBadRequest)
+			logger.FromContext(c).Error("CreateUserHandler() - Email-id already exists")
+			emailExists(c)
 			return
 		}
 
@@ -103,15 +143,40 @@ func CreateUserHandler(db *gorm.DB) gin.HandlerFunc {
 		// Hash the password using bcrypt
 		if err := user.HashPassword(); err != nil {
 			// fmt.Println("CreateUserHandler() - Error hashing password")
-			logger.Logger.Error("CreateUserHandler() - Error hashing password")
-			c.Status(http.StatusInternalServerError)
+			logger.FromContext(c).Error("CreateUserHandler() - Error hashing password")
+			apierror.Internal(c)
 			return
 		}
 
-		if err := db.Create(&user).Error; err != nil {
+		// Persist the user and queue its verification message atomically. The
+		// OutboxRelay publishes the message.
+		verification, token, err := newEmailVerification(user.Username)
+		if err != nil {
+			logger.FromContext(c).Error("CreateUserHandler() - Error generating verification token")
+			apierror.Internal(c)
+			return
+		}
+		outboxMsg, err := newOutboxMessage(c.Request.Context(), VerificationTopic, VerificationMessage{
+			Email:             user.Username,
+			VerificationToken: token,
+		}, map[string]string{
+			"email": user.Username,
+		})
+		if err != nil {
+			logger.FromContext(c).Error("CreateUserHandler() - Error building verification message")
+			apierror.Internal(c)
+			return
+		}
+		err = store.Users.CreateUser(c.Request.Context(), &user, verification, outboxMsg)
+		if errors.Is(err, ErrUsernameTaken) {
+			logger.FromContext(c).Error("CreateUserHandler() - Email-id already exists")
+			emailExists(c)
+			return
+		}
+		if err != nil {
 			// fmt.Println("CreateUserHandler() - Error saving user to database")
-			logger.Logger.Error("CreateUserHandler() - Error saving user to database")
-			c.Status(http.StatusInternalServerError)
+			logger.FromContext(c).Error("CreateUserHandler() - Error saving user to database")
+			AbortStoreError(c, err)
 			return
 		}
 
@@ -121,7 +186,7 @@ func CreateUserHandler(db *gorm.DB) gin.HandlerFunc {
 		updatedAtformatted := user.UpdatedAt.UTC().Format(time.RFC3339Nano)
 		updatedAtformatted = strings.Replace(updatedAtformatted, "+00:00", "Z", 1)
 
-		logger.Logger.WithFields(logrus.Fields{
+		logger.FromContext(c).WithFields(logrus.Fields{
 			"id":              user.ID,
 			"first_name":      user.FirstName,
 			"last_name":       user.LastName,
@@ -130,55 +195,6 @@ func CreateUserHandler(db *gorm.DB) gin.HandlerFunc {
 			"account_updated": updatedAtformatted,
 		}).Info("User created successfully")
 
-		// Initialize Pub/Sub client
-		ctx := context.Background()
-		if os.Getenv("SKIP_PUBSUB") != "true" {
-			pubsubClient, err := pubsub.NewClient(ctx, projectID)
-			if err != nil {
-				logger.Logger.Errorf("Failed to create Pub/Sub client: %v", err)
-				c.Status(http.StatusInternalServerError)
-				return
-			}
-			defer pubsubClient.Close()
-
-			// Get the Pub/Sub topic
-			topic := pubsubClient.Topic(topicName)
-
-			// Create an instance of VerificationMessage with the necessary data
-			vMessage := VerificationMessage{
-				Email:             user.Username,
-				VerificationToken: verMsg.VerificationToken,
-			}
-
-			// Marshal the VerificationMessage into JSON
-			jsonData, err := json.Marshal(vMessage)
-			if err != nil {
-				logger.Logger.Errorf("Error marshaling verification message: %v", err)
-				c.Status(http.StatusInternalServerError)
-				return
-			}
-
-			// Prepare and publish the message with jsonData
-			msg := &pubsub.Message{
-				Data: jsonData,
-				Attributes: map[string]string{
-					"email": user.Username,
-				},
-			}
-
-			result := topic.Publish(ctx, msg)
-
-			// Wait for the result
-			id, err := result.Get(ctx)
-			if err != nil {
-				logger.Logger.Errorf("Failed to publish to Pub/Sub: %v", err)
-				c.Status(http.StatusInternalServerError)
-				return
-			}
-			logger.Logger.Infof("Published message with ID: %s", id)
-
-		}
-
 		c.JSON(http.StatusCreated, gin.H{
 			"id":              user.ID,
 			"first_name":      user.FirstName,
@@ -188,35 +204,42 @@ func CreateUserHandler(db *gorm.DB) gin.HandlerFunc {
 			"account_updated": updatedAtformatted,
 		})
 
-		logger.Logger.Debug("Completed Execution of CreateUserHandler")
+		logger.FromContext(c).Debug("Completed Execution of CreateUserHandler")
 
 	}
 }
 
+func emailExists(c *gin.Context) {
+	apierror.Abort(c, http.StatusConflict, apierror.CodeEmailExists, "An account with this email address already exists")
+}
+
+// CheckPassword compares password with the user's stored hash, whichever
+// supported algorithm produced it.
 func (u *UserModel) CheckPassword(password string) error {
-	return bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
+	defer metrics.ObserveSince(metrics.PasswordHashDuration.WithLabelValues("compare"), time.Now())
+	return ComparePassword(u.Password, password)
 }
 
-func GetUserDetails(db *gorm.DB) gin.HandlerFunc {
+func GetUserDetails(store *Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if c.Request.ContentLength > 0 || len(c.Request.URL.Query()) > 0 {
-			c.Status(http.StatusBadRequest)
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeUnexpectedInput, "Request must not include a body or query parameters")
 			return
 		}
 
 		username, exists := c.Get("username")
 		if !exists {
 			// fmt.Println("GetUserDetails() -Error:: User not authenticated")
-			logger.Logger.Error("GetUserDetails() - User not authenticated")
-			c.Status(http.StatusUnauthorized)
+			logger.FromContext(c).Error("GetUserDetails() - User not authenticated")
+			apierror.Abort(c, http.StatusUnauthorized, apierror.CodeAuthRequired, "Authentication required")
 			return
 		}
 
-		var user UserModel
-		if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		user, err := store.Users.FindUserByUsername(c.Request.Context(), username.(string))
+		if err != nil {
 			// fmt.Println("GetUserDetails() - Error: Failed to retrieve user details")
-			logger.Logger.Error("GetUserDetails() - Failed to retrieve user details")
-			c.Status(http.StatusInternalServerError)
+			logger.FromContext(c).Error("GetUserDetails() - Failed to retrieve user details")
+			AbortStoreError(c, err)
 			return
 		}
 
@@ -226,7 +249,7 @@ func GetUserDetails(db *gorm.DB) gin.HandlerFunc {
 		updatedAtformatted := user.UpdatedAt.UTC().Format(time.RFC3339Nano)
 		updatedAtformatted = strings.Replace(updatedAtformatted, "+00:00", "Z", 1)
 
-		logger.Logger.WithFields(logrus.Fields{
+		logger.FromContext(c).WithFields(logrus.Fields{
 			"id":              user.ID,
 			"first_name":      user.FirstName,
 			"last_name":       user.LastName,
@@ -243,13 +266,16 @@ func GetUserDetails(db *gorm.DB) gin.HandlerFunc {
 			"account_created": createdAtFormatted,
 			"account_updated": updatedAtformatted,
 		})
-		logger.Logger.Debug("Completed Execution of GetUserDetails")
+		logger.FromContext(c).Debug("Completed Execution of GetUserDetails")
 	}
 }
 
-func ValidateCredentials(db *gorm.DB, username, password string) bool {
-	var user UserModel
-	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+// ValidateCredentials reports whether password is the password of username.
+// On success a hash made with another algorithm or cost than Hasher's is
+// replaced, since this is the only time the plain password is known.
+func ValidateCredentials(ctx context.Context, users UserRepository, username, password string) bool {
+	user, err := users.FindUserByUsername(ctx, username)
+	if err != nil {
 		return false
 	}
 
@@ -257,167 +283,217 @@ func ValidateCredentials(db *gorm.DB, username, password string) bool {
 		return false
 	}
 
+	if Hasher.NeedsRehash(user.Password) {
+		rehashPassword(ctx, users, user, password)
+	}
 	return true
 }
 
+// rehashPassword stores password hashed with Hasher, unless the stored hash
+// is no longer the one just verified: a concurrent password change or reset
+// must not be undone with the old password. Failures are logged only; the old
+// hash keeps working.
+func rehashPassword(ctx context.Context, users UserRepository, user *UserModel, password string) {
+	upgraded := UserModel{Password: password}
+	if err := upgraded.HashPassword(); err != nil {
+		logger.FromContext(ctx).Errorf("rehashPassword() - Failed to hash password: %v", err)
+		return
+	}
+	replaced, err := users.ReplacePasswordHash(ctx, user.ID, user.Password, upgraded.Password)
+	if err != nil {
+		logger.FromContext(ctx).Errorf("rehashPassword() - Failed to store upgraded hash: %v", err)
+		return
+	}
+	if !replaced {
+		logger.FromContext(ctx).WithField("id", user.ID).Info("rehashPassword() - Password changed meanwhile, skipped upgrade")
+		return
+	}
+	logger.FromContext(ctx).WithField("id", user.ID).Info("rehashPassword() - Upgraded password hash")
+}
+
 func GetUserID(c *gin.Context) uuid.UUID {
 	userID, exists := c.Get("userID")
 	if !exists {
 		// fmt.Println("GetUserID() - Error: Not able to get user ID")
-		logger.Logger.Error("GetUserID() - Not able to get user ID")
+		logger.FromContext(c).Error("GetUserID() - Not able to get user ID")
 		return uuid.Nil
 	}
 	return userID.(uuid.UUID)
 }
 
-func updateUserDetails(db *gorm.DB, userID uuid.UUID, firstName, lastName, password string) error {
-	var user UserModel
-	updateFields := make(map[string]interface{})
-	if firstName != "" {
-		updateFields["FirstName"] = firstName
-	}
-	if lastName != "" {
-		updateFields["LastName"] = lastName
+func updateUserDetails(ctx context.Context, users UserRepository, userID uuid.UUID, firstName, lastName, password string) error {
+	changes := UserModel{
+		FirstName: firstName,
+		LastName:  lastName,
 	}
 	if password != "" {
-		user.Password = password
-		if err := user.HashPassword(); err != nil {
+		changes.Password = password
+		if err := changes.HashPassword(); err != nil {
 			return err
 		}
-		updateFields["Password"] = user.Password
 	}
+	return users.UpdateUser(ctx, userID, changes)
+}
 
-	result := db.Model(&UserModel{}).Where("id = ?", userID).Updates(updateFields)
-	if result.Error != nil {
-		return result.Error
+// updatableFields are the fields a user may change on /v6/user/self.
+var updatableFields = []string{"first_name", "last_name", "password"}
+
+// bindUserDetails reads the fields of an update request. Every provided field
+// must be allowed and a non-empty string, and a new password must satisfy
+// PasswordRules; when requireAll is set every updatable field must be
+// present. Field problems are reported together. On failure the response has
+// been written.
+func bindUserDetails(c *gin.Context, caller string, requireAll bool) (map[string]string, bool) {
+	userDetails := make(map[string]interface{})
+	if err := c.ShouldBindJSON(&userDetails); err != nil {
+		logger.FromContext(c).Errorf("%s() - Invalid request", caller)
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidJSON, "Request body must be valid JSON")
+		return nil, false
 	}
-	return nil
-}
 
-func UpdateUserHandler(db *gorm.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		userDetails := make(map[string]interface{})
-		if err := c.BindJSON(&userDetails); err != nil {
-			// fmt.Println("UpdateUserHandler() - Error: Invalid request")
-			logger.Logger.Error("UpdateUserHandler() - Invalid request")
-			c.Status(http.StatusBadRequest)
-			return
+	allowedFields := make(map[string]bool, len(updatableFields))
+	for _, field := range updatableFields {
+		allowedFields[field] = true
+	}
+
+	var details []apierror.FieldError
+	fields := make(map[string]string, len(userDetails))
+	for key, value := range userDetails {
+		if !allowedFields[key] {
+			logger.FromContext(c).Errorf("%s() - Field '%s' not allowed", caller, key)
+			details = append(details, apierror.FieldError{Field: key, Code: "not_allowed", Message: key + " cannot be updated"})
+			continue
 		}
 
-		allowedFields := map[string]bool{
-			"first_name": true,
-			"last_name":  true,
-			"password":   true,
+		valueStr, ok := value.(string)
+		if !ok || strings.TrimSpace(valueStr) == "" {
+			logger.FromContext(c).Errorf("%s() - Field '%s' cannot be empty", caller, key)
+			details = append(details, apierror.FieldError{Field: key, Code: "required", Message: key + " must be a non-empty string"})
+			continue
 		}
+		fields[key] = valueStr
 
-		providedFieldsCount := 0
-		for key, value := range userDetails {
-			if allowedFields[key] {
-				if valueStr, ok := value.(string); ok && valueStr != "" {
-					providedFieldsCount++
-				} else {
-					// fmt.Printf("UpdateUserHandler() - Error: Field '%s' cannot be empty\n", key)
-					logger.Logger.Errorf("UpdateUserHandler() - Field '%s' cannot be empty", key)
-					c.Status(http.StatusBadRequest)
-					return
-				}
-			} else {
-				// fmt.Printf("UpdateUserHandler() - Error: Field '%s' not allowed\n", key)
-				logger.Logger.Errorf("UpdateUserHandler() - Field '%s' not allowed", key)
-				c.Status(http.StatusBadRequest)
-				return
+		if key == "password" {
+			details = append(details, PasswordRules.Check(c, key, valueStr, c.GetString("username"))...)
+		}
+	}
+
+	if requireAll {
+		for _, field := range updatableFields {
+			if _, provided := userDetails[field]; !provided {
+				details = append(details, apierror.FieldError{Field: field, Code: "required", Message: field + " is required"})
 			}
 		}
+	}
+
+	if len(details) > 0 {
+		sort.SliceStable(details, func(i, j int) bool { return details[i].Field < details[j].Field })
+		apierror.AbortWithDetails(c, http.StatusBadRequest, apierror.CodeValidationFailed, "Request validation failed", details)
+		return nil, false
+	}
 
-		if providedFieldsCount < 3 {
-			// fmt.Println("UpdateUserHandler() - Error: At least three fields must be provided for update with non-empty values")
-			logger.Logger.Error("UpdateUserHandler() -  At least three fields must be provided for update with non-empty values")
-			c.Status(http.StatusBadRequest)
+	if len(fields) == 0 {
+		logger.FromContext(c).Errorf("%s() - At least one field must be provided for update", caller)
+		apierror.Abort(c, http.StatusBadRequest, apierror.CodeValidationFailed, "At least one of "+strings.Join(updatableFields, ", ")+" must be provided")
+		return nil, false
+	}
+
+	return fields, true
+}
+
+// UpdateUserHandler replaces the user's details; every updatable field must
+// be provided.
+func UpdateUserHandler(store *Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		fields, ok := bindUserDetails(c, "UpdateUserHandler", true)
+		if !ok {
 			return
 		}
 
 		userID := GetUserID(c)
 
-		firstName, _ := userDetails["first_name"].(string)
-		lastName, _ := userDetails["last_name"].(string)
-		password, _ := userDetails["password"].(string)
-
-		if err := updateUserDetails(db, userID, firstName, lastName, password); err != nil {
+		if err := updateUserDetails(c.Request.Context(), store.Users, userID, fields["first_name"], fields["last_name"], fields["password"]); err != nil {
 			// fmt.Println("UpdateUserHandler() - Error: Failed to update user details")
-			logger.Logger.Error("UpdateUserHandler() - Failed to update user details")
-			c.Status(http.StatusInternalServerError)
+			logger.FromContext(c).Error("UpdateUserHandler() - Failed to update user details")
+			AbortStoreError(c, err)
 			return
 		}
 
 		// fmt.Println("UpdateUserHandler() - User details updated successfully")
-		logger.Logger.Info("UpdateUserHandler() - User details updated successfully")
+		logger.FromContext(c).Info("UpdateUserHandler() - User details updated successfully")
 		c.Status(http.StatusNoContent)
-		logger.Logger.Debug("Completed Execution of UpdateUserHandler")
+		logger.FromContext(c).Debug("Completed Execution of UpdateUserHandler")
 	}
 }
 
-func VerifyUserHandler(db *gorm.DB) gin.HandlerFunc {
+// PatchUserHandler updates any non-empty subset of the user's details.
+func PatchUserHandler(store *Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		tokenParam := c.Query("token")
-		if tokenParam == "" {
-			logger.Logger.Error("VerifyUserHandler() - Missing token")
-			c.Status(http.StatusBadRequest)
+		fields, ok := bindUserDetails(c, "PatchUserHandler", false)
+		if !ok {
 			return
 		}
 
-		token, err := uuid.Parse(tokenParam)
-		if err != nil {
-			logger.Logger.Error("VerifyUserHandler() - Invalid token format")
-			c.Status(http.StatusBadRequest)
+		userID := GetUserID(c)
+
+		if err := updateUserDetails(c.Request.Context(), store.Users, userID, fields["first_name"], fields["last_name"], fields["password"]); err != nil {
+			logger.FromContext(c).Error("PatchUserHandler() - Failed to update user details")
+			AbortStoreError(c, err)
 			return
 		}
 
-		var user UserModel
-		if err := db.Where("id = ?", token).First(&user).Error; err != nil {
-			logger.Logger.Error("VerifyUserHandler() - ID not found")
-			c.Status(http.StatusNotFound)
+		logger.FromContext(c).Info("PatchUserHandler() - User details updated successfully")
+		c.Status(http.StatusNoContent)
+		logger.FromContext(c).Debug("Completed Execution of PatchUserHandler")
+	}
+}
+
+func VerifyUserHandler(store *Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.Query("token")
+		if token == "" {
+			logger.FromContext(c).Error("VerifyUserHandler() - Missing token")
+			apierror.AbortWithDetails(c, http.StatusBadRequest, apierror.CodeValidationFailed, "Request validation failed", []apierror.FieldError{
+				{Field: "token", Code: "required", Message: "token is required"},
+			})
 			return
 		}
 
-		// // Check if the request is within 2 minutes of the user's creation time
-		// if time.Since(user.CreatedAt) > 2*time.Minute {
-		// 	logger.Logger.Error("VerifyUserHandler() - Verification link expired")
-		// 	c.Status(http.StatusBadRequest)
-		// 	return
-		// }
-
-		// Fetch the EmailVerification record associated with the user
-		var emailVerification EmailVerification
-		if err := db.Where("uuid = ?", user.ID).First(&emailVerification).Error; err != nil {
-			logger.Logger.Error("VerifyUserHandler() - Failed to retrieve email verification details")
-			c.Status(http.StatusUnauthorized)
+		tokenHash := hashToken(token)
+		emailVerification, err := store.Verifications.FindVerification(c.Request.Context(), tokenHash)
+		if errors.Is(err, ErrNotFound) {
+			// The token may confirm a new address instead, see
+			// RequestEmailChangeHandler.
+			confirmEmailChange(c, store, tokenHash)
+			return
+		}
+		if err != nil {
+			logger.FromContext(c).Error("VerifyUserHandler() - Failed to look up token")
+			AbortStoreError(c, err)
 			return
 		}
-
-		// // Check if the request is within 2 minutes of the email's TimeSent
-		// if time.Since(emailVerification.ExpiryTime) > 2*time.Minute {
-		// 	logger.Logger.Error("VerifyUserHandler() - Verification link expired")
-		// 	c.Status(http.StatusBadRequest)
-		// 	return
-		// }
 
 		if time.Now().After(emailVerification.ExpiryTime) {
-			logger.Logger.Error("VerifyUserHandler() - Verification link expired")
-			c.Status(http.StatusBadRequest)
+			logger.FromContext(c).Error("VerifyUserHandler() - Verification link expired")
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeTokenExpired, "Token has expired")
 			return
 		}
 
-		// Update the isVerified flag
-		user.IsVerified = true
-		if err := db.Save(&user).Error; err != nil {
-			logger.Logger.Error("VerifyUserHandler() - Failed to verify user")
-			c.Status(http.StatusUnauthorized)
+		err = store.Verifications.ConsumeVerification(c.Request.Context(), emailVerification)
+		if errors.Is(err, ErrNotFound) {
+			logger.FromContext(c).Error("VerifyUserHandler() - Token already used or user not found")
+			apierror.Abort(c, http.StatusNotFound, apierror.CodeInvalidToken, "Token is invalid or has already been used")
+			return
+		}
+		if err != nil {
+			logger.FromContext(c).Error("VerifyUserHandler() - Failed to verify user")
+			AbortStoreError(c, err)
 			return
 		}
 
-		logger.Logger.Info("User verified successfully")
+		logger.FromContext(c).Info("User verified successfully")
 		c.JSON(http.StatusOK, gin.H{"message": "User verified successfully"})
 
-		logger.Logger.Debug("Completed Execution of VerifyUserHandler")
+		logger.FromContext(c).Debug("Completed Execution of VerifyUserHandler")
 	}
 }
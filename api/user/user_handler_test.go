@@ -0,0 +1,345 @@
+package user
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"webapp/api/apierror"
+	"webapp/db"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestEngine routes the handlers under test to store. Requests carrying an
+// X-Test-User header are treated as authenticated as that user ID. Messages
+// queued by a request are published to publisher once it completes.
+func newTestEngine(t *testing.T, store *Store, publisher Publisher) *gin.Engine {
+	hasher := Hasher
+	Hasher = BcryptHasher{Cost: bcrypt.MinCost}
+	t.Cleanup(func() { Hasher = hasher })
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(func(c *gin.Context) {
+		c.Next()
+		if repo, ok := store.Outbox.(*MemoryRepository); ok {
+			relayOutbox(t, repo, publisher)
+		}
+	})
+	engine.POST("/v6/user", CreateUserHandler(store))
+	engine.GET("/verify", VerifyUserHandler(store))
+	engine.POST("/v6/user/resend-verification", ResendVerificationHandler(store))
+	engine.POST("/v6/user/password/reset/request", RequestPasswordResetHandler(store))
+	engine.POST("/v6/user/password/reset", ConfirmPasswordResetHandler(store))
+	engine.POST("/v6/user/token/refresh", RefreshTokenHandler(store))
+
+	authenticated := engine.Group("/", func(c *gin.Context) {
+		id, err := uuid.Parse(c.GetHeader("X-Test-User"))
+		if err != nil {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		account, err := store.Users.FindUserByID(c.Request.Context(), id)
+		if err != nil {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Set("userID", account.ID)
+		c.Set("username", account.Username)
+	})
+	authenticated.GET("/v6/user/self", GetUserDetails(store))
+	authenticated.PUT("/v6/user/self", UpdateUserHandler(store))
+	authenticated.PATCH("/v6/user/self", PatchUserHandler(store))
+	authenticated.POST("/v6/user/self/email", RequestEmailChangeHandler(store))
+	authenticated.DELETE("/v6/user/self", DeleteUserHandler(store))
+	// The router only lets Basic credentials reach LoginHandler.
+	authenticated.POST("/v6/user/login", func(c *gin.Context) { c.Set("authMethod", "basic") }, LoginHandler(store))
+	return engine
+}
+
+// relayOutbox publishes the pending outbox messages of outbox, as the
+// OutboxRelay started by main does.
+func relayOutbox(t *testing.T, outbox OutboxRepository, publisher Publisher) {
+	assert.NoError(t, NewOutboxRelay(outbox, publisher).Drain(context.Background()))
+}
+
+func serve(engine *gin.Engine, method, target string, body interface{}, userID uuid.UUID) *httptest.ResponseRecorder {
+	var payload bytes.Buffer
+	if body != nil {
+		_ = json.NewEncoder(&payload).Encode(body)
+	}
+	req := httptest.NewRequest(method, target, &payload)
+	req.Header.Set("Content-Type", "application/json")
+	if userID != uuid.Nil {
+		req.Header.Set("X-Test-User", userID.String())
+	}
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	return w
+}
+
+func createTestUser(t *testing.T, engine *gin.Engine, username string) uuid.UUID {
+	w := serve(engine, http.MethodPost, "/v6/user", map[string]string{
+		"first_name": "Jane",
+		"last_name":  "Doe",
+		"password":   "s3cret-password",
+		"username":   username,
+	}, uuid.Nil)
+	assert.Equal(t, http.StatusCreated, w.Code)
+
+	var created struct {
+		ID uuid.UUID `json:"id"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	return created.ID
+}
+
+func TestCreateUserHandlerStoresUserAndPublishesVerification(t *testing.T) {
+	repo := NewMemoryRepository()
+	store := &Store{Users: repo, Verifications: repo, Outbox: repo}
+	publisher := NewMemoryPublisher()
+	engine := newTestEngine(t, store, publisher)
+
+	id := createTestUser(t, engine, "jane@example.com")
+
+	account, err := store.Users.FindUserByID(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, "jane@example.com", account.Username)
+	assert.False(t, account.IsVerified)
+	assert.NoError(t, account.CheckPassword("s3cret-password"))
+
+	messages := publisher.VerificationMessages(VerificationTopic)
+	assert.Len(t, messages, 1)
+	assert.Equal(t, "jane@example.com", messages[0].Email)
+
+	outbox := repo.OutboxMessages()
+	assert.Len(t, outbox, 1)
+	assert.Equal(t, VerificationTopic, outbox[0].Topic)
+}
+
+func TestCreateUserHandlerRejectsUsernameRegardlessOfCase(t *testing.T) {
+	store := NewMemoryStore()
+	engine := newTestEngine(t, store, NewMemoryPublisher())
+
+	id := createTestUser(t, engine, "  Jane.Doe@Example.com ")
+	account, err := store.Users.FindUserByID(context.Background(), id)
+	assert.NoError(t, err)
+	assert.Equal(t, "jane.doe@example.com", account.Username)
+
+	w := serve(engine, http.MethodPost, "/v6/user", map[string]string{
+		"first_name": "Jane",
+		"last_name":  "Doe",
+		"password":   "another-password",
+		"username":   "JANE.DOE@example.com",
+	}, uuid.Nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "email_already_exists")
+}
+
+// racingUsers hides the username from UsernameExists, as when a concurrent
+// signup commits between the check and the insert.
+type racingUsers struct {
+	UserRepository
+}
+
+func (racingUsers) UsernameExists(ctx context.Context, username string) (bool, error) {
+	return false, nil
+}
+
+func TestCreateUserHandlerTranslatesUniqueViolation(t *testing.T) {
+	repo := NewMemoryRepository()
+	store := &Store{Users: racingUsers{repo}, Verifications: repo, Outbox: repo}
+	engine := newTestEngine(t, store, NewMemoryPublisher())
+
+	createTestUser(t, engine, "race@example.com")
+
+	w := serve(engine, http.MethodPost, "/v6/user", map[string]string{
+		"first_name": "Jane",
+		"last_name":  "Doe",
+		"password":   "another-password",
+		"username":   "Race@example.com",
+	}, uuid.Nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "email_already_exists")
+}
+
+func TestVerifyUserHandlerConsumesToken(t *testing.T) {
+	store := NewMemoryStore()
+	publisher := NewMemoryPublisher()
+	engine := newTestEngine(t, store, publisher)
+
+	id := createTestUser(t, engine, "verify@example.com")
+	token := publisher.VerificationMessages(VerificationTopic)[0].VerificationToken
+
+	w := serve(engine, http.MethodGet, "/verify?token="+token, nil, uuid.Nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	account, err := store.Users.FindUserByID(context.Background(), id)
+	assert.NoError(t, err)
+	assert.True(t, account.IsVerified)
+
+	w = serve(engine, http.MethodGet, "/verify?token="+token, nil, uuid.Nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid_token")
+}
+
+func TestVerifyUserHandlerRejectsExpiredToken(t *testing.T) {
+	ttl := VerificationTokenTTL
+	VerificationTokenTTL = -time.Second
+	t.Cleanup(func() { VerificationTokenTTL = ttl })
+
+	store := NewMemoryStore()
+	publisher := NewMemoryPublisher()
+	engine := newTestEngine(t, store, publisher)
+
+	id := createTestUser(t, engine, "expired@example.com")
+	token := publisher.VerificationMessages(VerificationTopic)[0].VerificationToken
+
+	w := serve(engine, http.MethodGet, "/verify?token="+token, nil, uuid.Nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "token_expired")
+
+	account, err := store.Users.FindUserByID(context.Background(), id)
+	assert.NoError(t, err)
+	assert.False(t, account.IsVerified)
+}
+
+func TestUpdateAndGetUserDetails(t *testing.T) {
+	store := NewMemoryStore()
+	engine := newTestEngine(t, store, NewMemoryPublisher())
+
+	id := createTestUser(t, engine, "update@example.com")
+
+	w := serve(engine, http.MethodPatch, "/v6/user/self", map[string]string{"first_name": "Janet"}, id)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = serve(engine, http.MethodPut, "/v6/user/self", map[string]string{
+		"first_name": "Janet",
+		"last_name":  "Smith",
+		"password":   "new-password",
+	}, id)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = serve(engine, http.MethodGet, "/v6/user/self", nil, id)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var details map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &details))
+	assert.Equal(t, "Janet", details["first_name"])
+	assert.Equal(t, "Smith", details["last_name"])
+	assert.NotContains(t, details, "password")
+
+	account, err := store.Users.FindUserByID(context.Background(), id)
+	assert.NoError(t, err)
+	assert.NoError(t, account.CheckPassword("new-password"))
+}
+
+func TestHandlersAnswer503WhileDatabaseUnavailable(t *testing.T) {
+	store := NewPostgresStore(db.NewProvider(""))
+	engine := newTestEngine(t, store, NewMemoryPublisher())
+
+	w := serve(engine, http.MethodPost, "/v6/user", map[string]string{
+		"first_name": "Jane",
+		"last_name":  "Doe",
+		"password":   "s3cret-password",
+		"username":   "jane@example.com",
+	}, uuid.Nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "service_unavailable")
+
+	w = serve(engine, http.MethodGet, "/verify?token=abc", nil, uuid.Nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestResendVerificationAndPasswordResetUseStore(t *testing.T) {
+	store := NewMemoryStore()
+	publisher := NewMemoryPublisher()
+	engine := newTestEngine(t, store, publisher)
+	createTestUser(t, engine, "jane@example.com")
+
+	w := serve(engine, http.MethodPost, "/v6/user/resend-verification", map[string]string{"username": "Jane@Example.com"}, uuid.Nil)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	messages := publisher.VerificationMessages(VerificationTopic)
+	assert.Len(t, messages, 2)
+	assert.NotEqual(t, messages[0].VerificationToken, messages[1].VerificationToken)
+
+	// Only the rotated token is still valid.
+	w = serve(engine, http.MethodGet, "/verify?token="+messages[0].VerificationToken, nil, uuid.Nil)
+	assert.NotEqual(t, http.StatusOK, w.Code)
+	w = serve(engine, http.MethodGet, "/verify?token="+messages[1].VerificationToken, nil, uuid.Nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = serve(engine, http.MethodPost, "/v6/user/password/reset/request", map[string]string{"username": "jane@example.com"}, uuid.Nil)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	w = serve(engine, http.MethodPost, "/v6/user/password/reset/request", map[string]string{"username": "nobody@example.com"}, uuid.Nil)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	var resets []PublishedMessage
+	for _, msg := range publisher.Messages() {
+		if msg.Topic == PasswordResetTopic {
+			resets = append(resets, msg)
+		}
+	}
+	assert.Len(t, resets, 1)
+}
+
+func TestAbortStoreErrorStatus(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for err, status := range map[error]int{
+		db.ErrUnavailable: http.StatusServiceUnavailable,
+		ErrNotFound:       http.StatusNotFound,
+		fmt.Errorf("update: %w", ErrUsernameTaken): http.StatusConflict,
+		errors.New("boom"):                         http.StatusInternalServerError,
+	} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		AbortStoreError(c, err)
+		assert.Equal(t, status, w.Code, err.Error())
+	}
+}
+
+// decodeError asserts that w carries the error envelope and returns it.
+func decodeError(t *testing.T, w *httptest.ResponseRecorder) apierror.Response {
+	t.Helper()
+	assert.Equal(t, "application/json; charset=utf-8", w.Header().Get("Content-Type"))
+	var response apierror.Response
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.NotEmpty(t, response.Message)
+	return response
+}
+
+func TestHandlersAnswerWithErrorEnvelope(t *testing.T) {
+	store := NewMemoryStore()
+	engine := newTestEngine(t, store, NewMemoryPublisher())
+
+	req := httptest.NewRequest(http.MethodPost, "/v6/user", bytes.NewBufferString(`{"username":`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	response := decodeError(t, w)
+	assert.Equal(t, apierror.CodeInvalidJSON, response.Code)
+	assert.Empty(t, response.Details)
+
+	w = serve(engine, http.MethodPost, "/v6/user", map[string]string{
+		"last_name": "Doe",
+		"password":  "s3cret-password",
+		"username":  "not-an-email",
+	}, uuid.Nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	response = decodeError(t, w)
+	assert.Equal(t, apierror.CodeValidationFailed, response.Code)
+	assert.ElementsMatch(t, []apierror.FieldError{
+		{Field: "first_name", Code: "required", Message: "first_name is required"},
+		{Field: "username", Code: "email", Message: "username must be a valid email address"},
+	}, response.Details)
+}
@@ -0,0 +1,108 @@
+package user
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"webapp/api/apierror"
+	"webapp/logger"
+	"webapp/ratelimit"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limits applied within ResendWindow to the unauthenticated endpoints that
+// send email: ResendVerificationHandler and RequestPasswordResetHandler.
+var (
+	ResendEmailLimit = 3
+	ResendIPLimit    = 10
+	ResendWindow     = time.Hour
+)
+
+type resendVerificationRequest struct {
+	Username string `json:"username" validate:"required,email"`
+}
+
+// ResendVerificationHandler rotates the verification token of an unverified
+// user and queues a new verification message. It responds with 202 whether
+// or not the username exists so it cannot be used to enumerate accounts.
+func ResendVerificationHandler(store *Store) gin.HandlerFunc {
+	emailLimiter := ratelimit.New(ResendEmailLimit, ResendWindow)
+	ipLimiter := ratelimit.New(ResendIPLimit, ResendWindow)
+
+	return func(c *gin.Context) {
+		var request resendVerificationRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			logger.FromContext(c).Error("ResendVerificationHandler() - Error in json body")
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeInvalidJSON, "Request body must be valid JSON")
+			return
+		}
+
+		request.Username = NormalizeUsername(request.Username)
+
+		if validationErr := validate.Struct(request); validationErr != nil {
+			logger.FromContext(c).Error("ResendVerificationHandler() - Validation Error")
+			apierror.Validation(c, validationErr)
+			return
+		}
+
+		if ok, retryAfter := ipLimiter.Allow(c.ClientIP()); !ok {
+			logger.FromContext(c).Error("ResendVerificationHandler() - Rate limit exceeded for client IP")
+			tooManyRequests(c, retryAfter)
+			return
+		}
+		if ok, retryAfter := emailLimiter.Allow(request.Username); !ok {
+			logger.FromContext(c).Error("ResendVerificationHandler() - Rate limit exceeded for email")
+			tooManyRequests(c, retryAfter)
+			return
+		}
+
+		user, err := store.Users.FindUserByUsername(c.Request.Context(), request.Username)
+		if errors.Is(err, ErrNotFound) || (err == nil && user.IsVerified) {
+			logger.FromContext(c).Info("ResendVerificationHandler() - No unverified user for username, nothing sent")
+			c.JSON(http.StatusAccepted, gin.H{"message": "Verification email sent if the account is pending verification"})
+			return
+		}
+		if err != nil {
+			logger.FromContext(c).Error("ResendVerificationHandler() - Failed to retrieve user")
+			AbortStoreError(c, err)
+			return
+		}
+
+		verification, token, err := newEmailVerification(user.Username)
+		if err != nil {
+			logger.FromContext(c).Error("ResendVerificationHandler() - Error generating verification token")
+			apierror.Internal(c)
+			return
+		}
+		outboxMsg, err := newOutboxMessage(c.Request.Context(), VerificationTopic, VerificationMessage{
+			Email:             user.Username,
+			VerificationToken: token,
+		}, map[string]string{
+			"email": user.Username,
+		})
+		if err != nil {
+			logger.FromContext(c).Error("ResendVerificationHandler() - Error building verification message")
+			apierror.Internal(c)
+			return
+		}
+
+		if err := store.Verifications.RotateVerification(c.Request.Context(), verification, outboxMsg); err != nil {
+			logger.FromContext(c).Error("ResendVerificationHandler() - Failed to rotate email verification")
+			AbortStoreError(c, err)
+			return
+		}
+
+		logger.FromContext(c).Info("ResendVerificationHandler() - Verification email queued")
+		c.JSON(http.StatusAccepted, gin.H{"message": "Verification email sent if the account is pending verification"})
+		logger.FromContext(c).Debug("Completed Execution of ResendVerificationHandler")
+	}
+}
+
+func tooManyRequests(c *gin.Context, retryAfter time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	apierror.Abort(c, http.StatusTooManyRequests, apierror.CodeRateLimited, "Too many requests, try again later")
+}
@@ -8,6 +8,7 @@ DB_USER=$(get_secret "db-user")
 DB_PASSWORD=$(get_secret "db-password")
 DB_NAME=$(get_secret "db-name")
 DB_HOST=$(get_secret "db-host")
+TOKEN_SIGNING_KEY=$(get_secret "token-signing-key")
 BOOT_DISK_KMS_KEY=$(get_secret "vm-key")
 
 echo "$DB_PASSWORD"
@@ -22,6 +23,7 @@ if [ ! -f /etc/webapp.flag ]; then
   echo "DB_PASSWORD=$DB_PASSWORD" >> /etc/webapp.env
   echo "DB_NAME=$DB_NAME" >> /etc/webapp.env 
   echo "DB_HOST=$DB_HOST" >> /etc/webapp.env 
+  echo "TOKEN_SIGNING_KEY=$TOKEN_SIGNING_KEY" >> /etc/webapp.env
   sudo chown csye6225:csye6225 /etc/systemd/system/webapp.service 
   sudo touch /etc/webapp.flag 
 else 
@@ -64,6 +66,31 @@ gcloud compute instance-groups managed set-instance-template $INSTANCE_GROUP_NAM
 
 echo "Updated instance group ${INSTANCE_GROUP_NAME} to use new template: ${NEW_INSTANCE_TEMPLATE_URL}"
 
+# Autohealing recreates instances whose process stopped answering /livez. It
+# must not use /readyz: a database outage would then recreate every instance
+# instead of only taking them out of the load balancer.
+AUTOHEAL_HEALTH_CHECK=${AUTOHEAL_HEALTH_CHECK:-webapp-livez}
+if ! gcloud compute health-checks describe $AUTOHEAL_HEALTH_CHECK --project=$GCP_PROJECT_ID > /dev/null 2>&1; then
+  gcloud compute health-checks create http $AUTOHEAL_HEALTH_CHECK \
+    --request-path=/livez \
+    --port=8080 \
+    --check-interval=10s \
+    --timeout=5s \
+    --unhealthy-threshold=3 \
+    --project=$GCP_PROJECT_ID
+fi
+gcloud compute instance-groups managed update $INSTANCE_GROUP_NAME \
+  --health-check=$AUTOHEAL_HEALTH_CHECK \
+  --initial-delay=300 \
+  --region=$REGION
+
+# The load balancer only routes to instances that answer /readyz.
+if [ -n "$LB_HEALTH_CHECK" ]; then
+  gcloud compute health-checks update http $LB_HEALTH_CHECK \
+    --request-path=/readyz \
+    --project=$GCP_PROJECT_ID
+fi
+
 gcloud compute instance-groups managed rolling-action start-update $INSTANCE_GROUP_NAME \
   --version=template=$NEW_INSTANCE_TEMPLATE_URL \
   --region=$REGION \
@@ -2,3 +2,18 @@
 sleep 30
 sudo systemctl restart webapp.service
 
+# Only report the boot as done once the webapp is ready to serve: database
+# reachable, migrations applied and publisher reachable.
+PORT=$(sed -n 's/^PORT=//p' /etc/webapp.env)
+READYZ="http://localhost:${PORT:-8080}/readyz"
+for attempt in $(seq 1 60); do
+  if curl -fsS -o /dev/null "$READYZ"; then
+    echo "webapp ready after $attempt checks"
+    exit 0
+  fi
+  sleep 5
+done
+
+echo "webapp not ready after 5 minutes:"
+curl -sS "$READYZ?verbose"
+exit 1
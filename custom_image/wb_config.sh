@@ -0,0 +1,5 @@
+echo Moving /tmp/webapp.yaml to /etc/webapp.yaml
+sudo mv /tmp/webapp.yaml /etc/webapp.yaml
+sudo chown root:csye6225 /etc/webapp.yaml
+sudo chmod 640 /etc/webapp.yaml
+sudo restorecon -v /etc/webapp.yaml
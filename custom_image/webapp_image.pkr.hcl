@@ -119,6 +119,15 @@ build {
     ]
   }
 
+  provisioner "file" {
+    source      = "./webapp.yaml"
+    destination = "/tmp/webapp.yaml"
+  }
+
+  provisioner "shell" {
+    script = "./wb_config.sh"
+  }
+
   provisioner "file" {
     source      = "./webapp.service"
     destination = "/tmp/webapp.service"
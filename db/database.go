@@ -1,37 +1,111 @@
 package db
 
 import (
-	"webapp/api/user"
+	"context"
+	"time"
+	"webapp/db/migrations"
 	"webapp/logger"
+	"webapp/tracing"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	gormlogger "gorm.io/gorm/logger"
 )
 
 type Config struct {
 	DSN string
 }
 
-func ConnectToDB(DSN string) (*gorm.DB, error) {
-	db, err := gorm.Open(postgres.Open(DSN), &gorm.Config{})
+// PoolConfig limits the connection pool, see database/sql. Zero values keep
+// the database/sql defaults.
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
+// Apply configures the pool behind conn.
+func (p PoolConfig) Apply(conn *gorm.DB) error {
+	sqlDB, err := conn.DB()
+	if err != nil {
+		return err
+	}
+	sqlDB.SetMaxOpenConns(p.MaxOpenConns)
+	if p.MaxIdleConns > 0 {
+		sqlDB.SetMaxIdleConns(p.MaxIdleConns)
+	}
+	sqlDB.SetConnMaxLifetime(p.ConnMaxLifetime)
+	sqlDB.SetConnMaxIdleTime(p.ConnMaxIdleTime)
+	return nil
+}
+
+// queryLogger reports slow and failed queries through logger.Logger, so they
+// pass its redaction hook, instead of GORM's default stdout logger.
+// ParameterizedQueries keeps bound values such as emails and password hashes
+// out of the logged SQL.
+var queryLogger = gormlogger.New(queryLogWriter{}, gormlogger.Config{
+	SlowThreshold:             200 * time.Millisecond,
+	LogLevel:                  gormlogger.Warn,
+	IgnoreRecordNotFoundError: true,
+	ParameterizedQueries:      true,
+})
+
+type queryLogWriter struct{}
+
+func (queryLogWriter) Printf(format string, args ...interface{}) {
+	logger.Logger.Warnf(format, args...)
+}
+
+// Open connects to Postgres without touching the schema.
+func Open(DSN string) (*gorm.DB, error) {
+	// TranslateError maps constraint violations to gorm.ErrDuplicatedKey and
+	// friends, so callers need not know Postgres error codes.
+	db, err := gorm.Open(postgres.Open(DSN), &gorm.Config{
+		TranslateError: true,
+		Logger:         queryLogger,
+	})
 	if err != nil {
 		// fmt.Println("Not able to connect to the Postgres Database")
-		logger.Logger.Error("ConnectToDB() - Not able to connect to the Postgres Database")
+		logger.Logger.Error("Open() - Not able to connect to the Postgres Database")
+		return nil, err
+	}
+	if err := db.Use(tracing.GormPlugin{}); err != nil {
+		closeDB(db)
+		return nil, err
+	}
+	return db, nil
+}
 
+// ConnectToDB connects to Postgres and applies pending schema migrations.
+// On failure the connection pool is closed again, so retries don't leak it.
+func ConnectToDB(ctx context.Context, DSN string) (*gorm.DB, error) {
+	db, err := Open(DSN)
+	if err != nil {
+		return nil, err
 	}
 
-	err = db.AutoMigrate(&user.UserModel{})
+	sqlDB, err := db.DB()
 	if err != nil {
-		// fmt.Println("Failed to migrate table schema")
-		logger.Logger.Error("ConnectToDB() - Failed to migrate UserModel table schema")
+		closeDB(db)
 		return nil, err
 	}
 
-	err = db.AutoMigrate(&user.EmailVerification{})
+	applied, err := migrations.Up(ctx, sqlDB)
 	if err != nil {
-		// fmt.Println("Failed to migrate table schema")
-		logger.Logger.Error("ConnectToDB() - Failed to migrate EmailVerification table schema")
+		logger.Logger.Errorf("ConnectToDB() - Failed to migrate database schema: %v", err)
+		sqlDB.Close()
 		return nil, err
 	}
-	return db, err
+	if applied > 0 {
+		logger.Logger.Infof("ConnectToDB() - Applied %d schema migrations", applied)
+	}
+	return db, nil
+}
+
+// closeDB closes the pool behind db, if it got as far as having one.
+func closeDB(db *gorm.DB) {
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.Close()
+	}
 }
@@ -0,0 +1,19 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestQueryLoggerOmitsBoundValues(t *testing.T) {
+	filter, ok := queryLogger.(gorm.ParamsFilter)
+	if !ok {
+		t.Fatal("query logger does not filter parameters")
+	}
+	sql, vars := filter.ParamsFilter(context.Background(), "SELECT * FROM user_models WHERE username = $1", "jane@example.com")
+	if sql != "SELECT * FROM user_models WHERE username = $1" || vars != nil {
+		t.Fatalf("ParamsFilter() = %q, %v; want the SQL without values", sql, vars)
+	}
+}
@@ -0,0 +1,47 @@
+package migrations
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoad(t *testing.T) {
+	migrations, err := Load()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, migrations)
+
+	for i, m := range migrations {
+		assert.NotEmpty(t, m.Up, "version %d has no up script", m.Version)
+		assert.NotEmpty(t, m.Down, "version %d has no down script", m.Version)
+		if i > 0 {
+			assert.Greater(t, m.Version, migrations[i-1].Version)
+		}
+	}
+}
+
+func TestOnlyInitialSchemaIsDestructive(t *testing.T) {
+	migrations, err := Load()
+	assert.NoError(t, err)
+
+	for _, m := range migrations {
+		assert.Equal(t, m.Version == 1, m.Destructive, "version %d", m.Version)
+	}
+}
+
+func TestRollbackPlan(t *testing.T) {
+	migrations := []Migration{{Version: 1}, {Version: 2}, {Version: 3}}
+	done := map[int64]time.Time{1: {}, 2: {}}
+
+	versions := func(plan []Migration) []int64 {
+		var out []int64
+		for _, m := range plan {
+			out = append(out, m.Version)
+		}
+		return out
+	}
+	assert.Equal(t, []int64{2}, versions(rollbackPlan(migrations, done, 1)))
+	assert.Equal(t, []int64{2, 1}, versions(rollbackPlan(migrations, done, -1)))
+	assert.Equal(t, []int64{2, 1}, versions(rollbackPlan(migrations, done, 5)))
+}
@@ -0,0 +1,8 @@
+-- destructive: drops every table of the service together with all accounts.
+-- "webapp migrate down" refuses to run it without --destroy-data.
+DROP TABLE IF EXISTS login_attempts;
+DROP TABLE IF EXISTS password_resets;
+DROP TABLE IF EXISTS refresh_tokens;
+DROP TABLE IF EXISTS outbox_messages;
+DROP TABLE IF EXISTS email_verifications;
+DROP TABLE IF EXISTS user_models;
@@ -0,0 +1,63 @@
+-- Baseline schema. Tables may already exist on databases previously managed
+-- by GORM AutoMigrate, so every statement is idempotent.
+
+CREATE TABLE IF NOT EXISTS user_models (
+    id          uuid PRIMARY KEY,
+    created_at  timestamptz,
+    updated_at  timestamptz,
+    first_name  text,
+    last_name   text,
+    password    text,
+    username    text,
+    is_verified boolean DEFAULT false
+);
+ALTER TABLE user_models ADD COLUMN IF NOT EXISTS deleted_at timestamptz;
+CREATE INDEX IF NOT EXISTS idx_user_models_deleted_at ON user_models (deleted_at);
+
+CREATE TABLE IF NOT EXISTS email_verifications (
+    email       varchar(100) PRIMARY KEY,
+    expiry_time timestamptz
+);
+ALTER TABLE email_verifications ADD COLUMN IF NOT EXISTS token_hash varchar(64);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_email_verifications_token_hash ON email_verifications (token_hash);
+
+CREATE TABLE IF NOT EXISTS outbox_messages (
+    id              uuid PRIMARY KEY,
+    created_at      timestamptz NOT NULL,
+    topic           varchar(255) NOT NULL,
+    payload         bytea NOT NULL,
+    attributes      text,
+    attempts        bigint NOT NULL DEFAULT 0,
+    next_attempt_at timestamptz NOT NULL,
+    published_at    timestamptz,
+    last_error      text
+);
+CREATE INDEX IF NOT EXISTS idx_outbox_messages_next_attempt_at ON outbox_messages (next_attempt_at);
+CREATE INDEX IF NOT EXISTS idx_outbox_messages_published_at ON outbox_messages (published_at);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id         uuid PRIMARY KEY,
+    created_at timestamptz,
+    user_id    uuid NOT NULL,
+    family_id  uuid NOT NULL,
+    token_hash varchar(64) NOT NULL,
+    expires_at timestamptz NOT NULL,
+    revoked_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens (user_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family_id ON refresh_tokens (family_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_refresh_tokens_token_hash ON refresh_tokens (token_hash);
+
+CREATE TABLE IF NOT EXISTS password_resets (
+    email       varchar(100) PRIMARY KEY,
+    token_hash  varchar(64),
+    expiry_time timestamptz
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_password_resets_token_hash ON password_resets (token_hash);
+
+CREATE TABLE IF NOT EXISTS login_attempts (
+    key             varchar(255) PRIMARY KEY,
+    failures        bigint NOT NULL DEFAULT 0,
+    last_failure_at timestamptz,
+    blocked_until   timestamptz
+);
@@ -0,0 +1 @@
+ALTER TABLE email_verifications ADD COLUMN IF NOT EXISTS uuid uuid UNIQUE;
@@ -0,0 +1,3 @@
+-- Verification tokens used to be the user's ID, stored in this column. They
+-- are now random and only their hash is kept in token_hash.
+ALTER TABLE email_verifications DROP COLUMN IF EXISTS uuid;
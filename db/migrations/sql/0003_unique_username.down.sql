@@ -0,0 +1,2 @@
+-- Normalized usernames are left as they are.
+DROP INDEX IF EXISTS idx_user_models_username;
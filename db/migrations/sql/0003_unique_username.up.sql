@@ -0,0 +1,26 @@
+-- Usernames are email addresses and compared case-insensitively. Existing
+-- rows are normalized the way the API now normalizes input. Accounts that
+-- only differ by case must be merged by hand before the index can be built,
+-- so the migration stops and lists them instead of failing on the index.
+DO $$
+DECLARE
+	conflicts text;
+BEGIN
+	SELECT string_agg(usernames, '; ') INTO conflicts FROM (
+		SELECT string_agg(username, ', ' ORDER BY username) AS usernames
+		FROM user_models
+		GROUP BY lower(btrim(username))
+		HAVING count(*) > 1
+	) duplicates;
+	IF conflicts IS NOT NULL THEN
+		RAISE EXCEPTION 'usernames that only differ by case or surrounding spaces must be merged before migrating: %', conflicts;
+	END IF;
+END
+$$;
+
+UPDATE user_models SET username = lower(btrim(username)) WHERE username <> lower(btrim(username));
+UPDATE email_verifications SET email = lower(btrim(email)) WHERE email <> lower(btrim(email));
+UPDATE password_resets SET email = lower(btrim(email)) WHERE email <> lower(btrim(email));
+
+-- Soft-deleted accounts keep their username until they are purged.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_user_models_username ON user_models (lower(username));
@@ -0,0 +1,8 @@
+-- Pending email address changes, confirmed through /verify. One per user.
+CREATE TABLE IF NOT EXISTS email_changes (
+    user_id     uuid PRIMARY KEY,
+    new_email   varchar(100) NOT NULL,
+    token_hash  varchar(64),
+    expiry_time timestamptz
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_email_changes_token_hash ON email_changes (token_hash);
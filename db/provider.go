@@ -0,0 +1,119 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+	"webapp/logger"
+
+	"gorm.io/gorm"
+)
+
+// ErrUnavailable is returned while no database connection is established.
+var ErrUnavailable = errors.New("database unavailable")
+
+// Provider owns the application's database connection. It connects in the
+// background, retrying with exponential backoff, and hands the connection to
+// callers once it is ready. Handlers consult it on every request, so a
+// connection established after startup is picked up immediately.
+type Provider struct {
+	dsn            string
+	Pool           PoolConfig
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	mu    sync.RWMutex
+	conn  *gorm.DB
+	ready chan struct{}
+}
+
+func NewProvider(dsn string) *Provider {
+	return &Provider{
+		dsn:            dsn,
+		InitialBackoff: time.Second,
+		MaxBackoff:     30 * time.Second,
+		ready:          make(chan struct{}),
+	}
+}
+
+// NewStaticProvider wraps an already open connection, e.g. in tests.
+func NewStaticProvider(conn *gorm.DB) *Provider {
+	p := NewProvider("")
+	p.set(conn)
+	return p
+}
+
+// Connect tries to connect until it succeeds or ctx is cancelled.
+func (p *Provider) Connect(ctx context.Context) error {
+	backoff := p.InitialBackoff
+	for {
+		conn, err := ConnectToDB(ctx, p.dsn)
+		if err == nil {
+			if err := p.Pool.Apply(conn); err != nil {
+				logger.Logger.Errorf("Provider.Connect() - Failed to configure connection pool: %v", err)
+			}
+			p.set(conn)
+			logger.Logger.Info("Provider.Connect() - Database connection established")
+			return nil
+		}
+
+		logger.Logger.Errorf("Provider.Connect() - Database connection failed, retrying in %s: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+func (p *Provider) set(conn *gorm.DB) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conn = conn
+	close(p.ready)
+}
+
+// DB returns the connection, or ErrUnavailable if it is not established yet.
+func (p *Provider) DB() (*gorm.DB, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.conn == nil {
+		return nil, ErrUnavailable
+	}
+	return p.conn, nil
+}
+
+// Ready reports whether the connection has been established.
+func (p *Provider) Ready() bool {
+	_, err := p.DB()
+	return err == nil
+}
+
+// Wait blocks until the connection is established or ctx is cancelled.
+func (p *Provider) Wait(ctx context.Context) (*gorm.DB, error) {
+	select {
+	case <-p.ready:
+		return p.DB()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close closes the connection pool if one was established.
+func (p *Provider) Close() error {
+	conn, err := p.DB()
+	if err != nil {
+		return nil
+	}
+	sqlDB, err := conn.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
@@ -0,0 +1,38 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestProviderUnavailableUntilConnected(t *testing.T) {
+	p := NewProvider("")
+	if p.Ready() {
+		t.Fatal("provider without a connection reports ready")
+	}
+	if _, err := p.DB(); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("DB() error = %v, want ErrUnavailable", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Wait() error = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestStaticProviderIsReady(t *testing.T) {
+	conn := &gorm.DB{}
+	p := NewStaticProvider(conn)
+	if !p.Ready() {
+		t.Fatal("static provider is not ready")
+	}
+	got, err := p.Wait(context.Background())
+	if err != nil || got != conn {
+		t.Fatalf("Wait() = %v, %v; want the wrapped connection", got, err)
+	}
+}
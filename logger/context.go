@@ -0,0 +1,58 @@
+package logger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type requestInfoKey struct{}
+
+// RequestInfo identifies the HTTP request a log entry belongs to.
+type RequestInfo struct {
+	ID     string
+	Method string
+	Path   string
+	Start  time.Time
+}
+
+// WithRequestInfo returns a copy of ctx carrying info.
+func WithRequestInfo(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// RequestInfoFrom returns the request info stored in ctx, if any.
+func RequestInfoFrom(ctx context.Context) (*RequestInfo, bool) {
+	info, ok := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info, ok
+}
+
+// FromContext returns a Logger entry annotated with the request_id, method,
+// path, user_id, latency so far and trace IDs of the request in ctx. It accepts a
+// *gin.Context, whose "userID" key is set once the caller is authenticated,
+// as well as a plain request context.
+func FromContext(ctx context.Context) *logrus.Entry {
+	entry := logrus.NewEntry(Logger)
+	if ctx == nil {
+		return entry
+	}
+
+	fields := logrus.Fields{}
+	if info, ok := RequestInfoFrom(ctx); ok {
+		fields["request_id"] = info.ID
+		fields["method"] = info.Method
+		fields["path"] = info.Path
+		fields["latency"] = time.Since(info.Start).String()
+	}
+	if userID := ctx.Value("userID"); userID != nil {
+		fields["user_id"] = fmt.Sprint(userID)
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		fields["trace_id"] = span.TraceID().String()
+		fields["span_id"] = span.SpanID().String()
+	}
+	return entry.WithContext(ctx).WithFields(fields)
+}
@@ -0,0 +1,49 @@
+package logger
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromContextWithRequestInfo(t *testing.T) {
+	ctx := WithRequestInfo(context.Background(), &RequestInfo{
+		ID:     "abc-123",
+		Method: "GET",
+		Path:   "/v6/user/self",
+		Start:  time.Now(),
+	})
+
+	entry := FromContext(ctx)
+	assert.Equal(t, "abc-123", entry.Data["request_id"])
+	assert.Equal(t, "GET", entry.Data["method"])
+	assert.Equal(t, "/v6/user/self", entry.Data["path"])
+	assert.Contains(t, entry.Data, "latency")
+	assert.NotContains(t, entry.Data, "user_id")
+}
+
+func TestFromContextWithGinContext(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.ContextWithFallback = true
+
+	var data map[string]interface{}
+	r.GET("/", func(c *gin.Context) {
+		c.Request = c.Request.WithContext(WithRequestInfo(c.Request.Context(), &RequestInfo{ID: "abc-123", Start: time.Now()}))
+		c.Set("userID", "42")
+		data = FromContext(c).Data
+	})
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	assert.Equal(t, "abc-123", data["request_id"])
+	assert.Equal(t, "42", data["user_id"])
+}
+
+func TestFromContextWithoutRequest(t *testing.T) {
+	assert.Empty(t, FromContext(context.Background()).Data)
+}
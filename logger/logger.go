@@ -1,8 +1,11 @@
 package logger
 
 import (
+	"fmt"
+	"io"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -33,18 +36,184 @@ func (f *CustomJSONFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 
 var Logger = logrus.New()
 
+// Options selects where Logger writes and at which level.
+type Options struct {
+	Level string
+	// Sinks lists the outputs entries are written to: file, stdout, stderr
+	// and syslog. Without sinks, entries go to stderr.
+	Sinks  []string
+	File   FileOptions
+	Syslog SyslogOptions
+
+	// Redact overrides DefaultRedactions per field; RedactionHashKey keys
+	// the hash action.
+	Redact           map[string]RedactAction
+	RedactionHashKey []byte
+}
+
+// FileOptions configures the file sink. The file is rotated once it grows
+// past MaxSizeMB and, if RotateInterval is set, at that interval.
+type FileOptions struct {
+	Path           string
+	MaxSizeMB      int
+	MaxBackups     int
+	MaxAgeDays     int
+	RotateInterval time.Duration
+	Compress       bool
+}
+
+// SyslogOptions configures the syslog sink. An empty Network and Address
+// use the local syslog daemon.
+type SyslogOptions struct {
+	Network string
+	Address string
+	Tag     string
+}
+
+var (
+	mu sync.Mutex
+	// closers release the sinks installed by the last Configure.
+	closers []io.Closer
+	// configuredHooks are the hooks installed by the last Configure.
+	configuredHooks []logrus.Hook
+)
+
 func init() {
 	Logger.Formatter = &CustomJSONFormatter{
 		JSONFormatter: logrus.JSONFormatter{
 			TimestampFormat: time.RFC3339Nano,
 		},
 	}
-	Logger.SetLevel(logrus.DebugLevel)
+	Logger.SetLevel(logrus.InfoLevel)
+	Logger.SetOutput(os.Stderr)
 
-	file, err := os.OpenFile("/var/log/webapp/webapp.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err == nil {
-		Logger.Out = file
-	} else {
-		Logger.Info("Failed to log to file, using default stderr")
+	redaction, _ := NewRedactionHook(nil, nil)
+	replaceConfiguredHooks([]logrus.Hook{redaction})
+}
+
+// Configure applies opts, replacing the sinks of any earlier call. If a sink
+// cannot be opened the error is returned and the current setup is kept.
+// Calling it again, e.g. on SIGHUP, reopens the sinks.
+func Configure(opts Options) error {
+	level, err := logrus.ParseLevel(opts.Level)
+	if err != nil {
+		return err
+	}
+
+	redaction, err := NewRedactionHook(opts.Redact, opts.RedactionHashKey)
+	if err != nil {
+		return err
+	}
+
+	var writers []io.Writer
+	var newClosers []io.Closer
+	// Redaction comes first so that sink hooks only see redacted entries.
+	newHooks := []logrus.Hook{redaction}
+	fail := func(err error) error {
+		for _, c := range newClosers {
+			c.Close()
+		}
+		return err
+	}
+	for _, sink := range opts.Sinks {
+		switch sink {
+		case "file":
+			file, err := newRotatingFile(opts.File)
+			if err != nil {
+				return fail(fmt.Errorf("file sink: %w", err))
+			}
+			writers = append(writers, file)
+			newClosers = append(newClosers, file)
+		case "stdout":
+			writers = append(writers, os.Stdout)
+		case "stderr":
+			writers = append(writers, os.Stderr)
+		case "syslog":
+			hook, closer, err := newSyslogHook(opts.Syslog)
+			if err != nil {
+				return fail(fmt.Errorf("syslog sink: %w", err))
+			}
+			newHooks = append(newHooks, hook)
+			newClosers = append(newClosers, closer)
+		default:
+			return fail(fmt.Errorf("unknown log sink %q", sink))
+		}
+	}
+
+	var out io.Writer
+	switch len(writers) {
+	case 0:
+		if len(newHooks) == 1 {
+			out = os.Stderr
+		} else {
+			out = io.Discard
+		}
+	case 1:
+		out = writers[0]
+	default:
+		out = io.MultiWriter(writers...)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	Logger.SetOutput(out)
+	replaceConfiguredHooks(newHooks)
+	Logger.SetLevel(level)
+	for _, c := range closers {
+		c.Close()
+	}
+	closers = newClosers
+	return nil
+}
+
+// replaceConfiguredHooks swaps the hooks of the previous Configure for
+// hooks, keeping hooks added by other means. Callers hold mu or run from
+// init.
+func replaceConfiguredHooks(hooks []logrus.Hook) {
+	old := make(map[logrus.Hook]bool, len(configuredHooks))
+	for _, h := range configuredHooks {
+		old[h] = true
+	}
+	// Configured hooks go first so redaction precedes every other hook.
+	replaced := make(logrus.LevelHooks)
+	for _, h := range hooks {
+		replaced.Add(h)
+	}
+	for level, levelHooks := range Logger.Hooks {
+		for _, h := range levelHooks {
+			if !old[h] {
+				replaced[level] = append(replaced[level], h)
+			}
+		}
+	}
+	Logger.ReplaceHooks(replaced)
+	configuredHooks = hooks
+}
+
+// SetLevel changes the level at runtime.
+func SetLevel(level string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	Logger.SetLevel(lvl)
+	return nil
+}
+
+// Close flushes and closes the configured sinks. Later entries go to stderr,
+// still redacted.
+func Close() error {
+	mu.Lock()
+	defer mu.Unlock()
+	Logger.SetOutput(os.Stderr)
+	// Keep the redaction hook, which Configure always installs first.
+	replaceConfiguredHooks(configuredHooks[:1])
+	var firstErr error
+	for _, c := range closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
+	closers = nil
+	return firstErr
 }
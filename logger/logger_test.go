@@ -0,0 +1,64 @@
+package logger
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigureFileSinkAndLevel(t *testing.T) {
+	defer Close()
+	path := filepath.Join(t.TempDir(), "logs", "webapp.log")
+
+	err := Configure(Options{Level: "warn", Sinks: []string{"file"}, File: FileOptions{Path: path}})
+	assert.NoError(t, err)
+	assert.Equal(t, logrus.WarnLevel, Logger.GetLevel())
+
+	Logger.Info("filtered out")
+	Logger.Warn("kept")
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "filtered out")
+	assert.Contains(t, string(data), "kept")
+
+	assert.NoError(t, SetLevel("debug"))
+	assert.Equal(t, logrus.DebugLevel, Logger.GetLevel())
+}
+
+func TestConfigureKeepsCurrentSetupOnError(t *testing.T) {
+	defer Close()
+	path := filepath.Join(t.TempDir(), "webapp.log")
+	assert.NoError(t, Configure(Options{Level: "info", Sinks: []string{"file"}, File: FileOptions{Path: path}}))
+
+	err := Configure(Options{Level: "debug", Sinks: []string{"file", "carrier-pigeon"}, File: FileOptions{Path: path}})
+	assert.Error(t, err)
+	assert.Equal(t, logrus.InfoLevel, Logger.GetLevel())
+
+	Logger.Info("still logging")
+	data, _ := os.ReadFile(path)
+	assert.Contains(t, string(data), "still logging")
+}
+
+func TestRotatingFileRotate(t *testing.T) {
+	dir := t.TempDir()
+	f, err := newRotatingFile(FileOptions{Path: filepath.Join(dir, "webapp.log"), MaxBackups: 1})
+	assert.NoError(t, err)
+	defer f.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := f.Write([]byte("line\n"))
+		assert.NoError(t, err)
+		assert.NoError(t, f.Rotate())
+	}
+
+	// The active file plus at most MaxBackups rotated ones; lumberjack prunes
+	// in the background, so allow it a moment.
+	assert.Eventually(t, func() bool {
+		entries, _ := os.ReadDir(dir)
+		return len(entries) <= 2
+	}, time.Second, 10*time.Millisecond)
+}
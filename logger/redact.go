@@ -0,0 +1,131 @@
+package logger
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RedactAction says what happens to a sensitive field before an entry is
+// written.
+type RedactAction string
+
+const (
+	// RedactMask keeps a hint of the value, e.g. j***@example.com.
+	RedactMask RedactAction = "mask"
+	// RedactHash replaces the value with a keyed hash, so entries about the
+	// same value can still be correlated.
+	RedactHash RedactAction = "hash"
+	// RedactDrop removes the field.
+	RedactDrop RedactAction = "drop"
+	// RedactKeep logs the field as is. It turns off a default policy.
+	RedactKeep RedactAction = "keep"
+)
+
+// DefaultRedactions is the policy applied unless overridden. A policy for
+// "token" also covers fields ending in "_token", such as refresh_token.
+var DefaultRedactions = map[string]RedactAction{
+	"password":      RedactDrop,
+	"token":         RedactDrop,
+	"authorization": RedactDrop,
+	"username":      RedactHash,
+	"lockout_key":   RedactHash,
+	"email":         RedactMask,
+	"first_name":    RedactMask,
+	"last_name":     RedactMask,
+}
+
+// RedactionHook rewrites sensitive fields of every entry. It must run
+// before any hook that writes the entry, which Configure ensures.
+type RedactionHook struct {
+	policy  map[string]RedactAction
+	hashKey []byte
+}
+
+// NewRedactionHook returns a hook applying overrides on top of
+// DefaultRedactions. hashKey keys the hash action; without it values are
+// hashed with plain SHA-256.
+func NewRedactionHook(overrides map[string]RedactAction, hashKey []byte) (*RedactionHook, error) {
+	policy := make(map[string]RedactAction, len(DefaultRedactions)+len(overrides))
+	for field, action := range DefaultRedactions {
+		policy[normalizeField(field)] = action
+	}
+	for field, action := range overrides {
+		switch action {
+		case RedactMask, RedactHash, RedactDrop:
+			policy[normalizeField(field)] = action
+		case RedactKeep:
+			delete(policy, normalizeField(field))
+		default:
+			return nil, fmt.Errorf("unknown redaction action %q for field %q", action, field)
+		}
+	}
+	return &RedactionHook{policy: policy, hashKey: hashKey}, nil
+}
+
+func (h *RedactionHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire redacts entry.Data in place. logrus hands hooks a copy of the entry,
+// so the caller's fields are untouched.
+func (h *RedactionHook) Fire(entry *logrus.Entry) error {
+	for field, value := range entry.Data {
+		action, ok := h.actionFor(field)
+		if !ok {
+			continue
+		}
+		switch action {
+		case RedactDrop:
+			delete(entry.Data, field)
+		case RedactMask:
+			entry.Data[field] = mask(fmt.Sprint(value))
+		case RedactHash:
+			entry.Data[field] = h.hash(fmt.Sprint(value))
+		}
+	}
+	return nil
+}
+
+func (h *RedactionHook) actionFor(field string) (RedactAction, bool) {
+	field = normalizeField(field)
+	if action, ok := h.policy[field]; ok {
+		return action, true
+	}
+	for name, action := range h.policy {
+		if strings.HasSuffix(field, "_"+name) {
+			return action, true
+		}
+	}
+	return "", false
+}
+
+func normalizeField(field string) string {
+	return strings.ReplaceAll(strings.ToLower(field), "-", "_")
+}
+
+// mask keeps the first character, and the domain of email addresses.
+func mask(value string) string {
+	if value == "" {
+		return ""
+	}
+	local, domain := value, ""
+	if at := strings.LastIndex(value, "@"); at > 0 {
+		local, domain = value[:at], value[at:]
+	}
+	return string([]rune(local)[:1]) + "***" + domain
+}
+
+func (h *RedactionHook) hash(value string) string {
+	if len(h.hashKey) == 0 {
+		sum := sha256.Sum256([]byte(value))
+		return "sha256:" + hex.EncodeToString(sum[:8])
+	}
+	mac := hmac.New(sha256.New, h.hashKey)
+	mac.Write([]byte(value))
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
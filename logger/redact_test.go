@@ -0,0 +1,76 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func redactedFields(t *testing.T, hook *RedactionHook, fields logrus.Fields) map[string]interface{} {
+	var buf bytes.Buffer
+	log := logrus.New()
+	log.Formatter = Logger.Formatter
+	log.SetOutput(&buf)
+	log.AddHook(hook)
+	log.WithFields(fields).Info("test")
+
+	var out map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestRedactionHookDefaults(t *testing.T) {
+	hook, err := NewRedactionHook(nil, []byte("key"))
+	assert.NoError(t, err)
+
+	fields := logrus.Fields{
+		"password":      "hunter2",
+		"refresh_token": "abc",
+		"Authorization": "Basic Zm9vOmJhcg==",
+		"username":      "jane@example.com",
+		"email":         "jane@example.com",
+		"first_name":    "Jane",
+		"id":            "42",
+	}
+	out := redactedFields(t, hook, fields)
+
+	assert.NotContains(t, out, "password")
+	assert.NotContains(t, out, "refresh_token")
+	assert.NotContains(t, out, "Authorization")
+	assert.Regexp(t, `^hmac-sha256:[0-9a-f]{16}$`, out["username"])
+	assert.Equal(t, "j***@example.com", out["email"])
+	assert.Equal(t, "J***", out["first_name"])
+	assert.Equal(t, "42", out["id"])
+
+	// The caller's fields are left alone.
+	assert.Equal(t, "hunter2", fields["password"])
+}
+
+func TestRedactionHookOverrides(t *testing.T) {
+	hook, err := NewRedactionHook(map[string]RedactAction{
+		"username":  RedactKeep,
+		"client-ip": RedactHash,
+	}, nil)
+	assert.NoError(t, err)
+
+	out := redactedFields(t, hook, logrus.Fields{"username": "jane", "client_ip": "10.0.0.1"})
+	assert.Equal(t, "jane", out["username"])
+	assert.Regexp(t, `^sha256:[0-9a-f]{16}$`, out["client_ip"])
+
+	_, err = NewRedactionHook(map[string]RedactAction{"username": "shred"}, nil)
+	assert.Error(t, err)
+}
+
+func TestLoggerRedactsByDefault(t *testing.T) {
+	var buf bytes.Buffer
+	Logger.SetOutput(&buf)
+	defer Close()
+
+	Logger.WithField("password", "hunter2").Info("test")
+	assert.NotContains(t, buf.String(), "hunter2")
+}
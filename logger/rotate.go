@@ -0,0 +1,68 @@
+package logger
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// rotatingFile is a log file rotated by size through lumberjack and,
+// optionally, on a fixed interval. Old files are removed once there are
+// more than MaxBackups of them or they are older than MaxAgeDays.
+type rotatingFile struct {
+	*lumberjack.Logger
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newRotatingFile(opts FileOptions) (*rotatingFile, error) {
+	// Open the file up front so a bad path is reported by Configure rather
+	// than on the first write.
+	if err := os.MkdirAll(filepath.Dir(opts.Path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(opts.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	f := &rotatingFile{
+		Logger: &lumberjack.Logger{
+			Filename:   opts.Path,
+			MaxSize:    opts.MaxSizeMB,
+			MaxBackups: opts.MaxBackups,
+			MaxAge:     opts.MaxAgeDays,
+			Compress:   opts.Compress,
+		},
+		stop: make(chan struct{}),
+	}
+	if opts.RotateInterval > 0 {
+		go f.rotateEvery(opts.RotateInterval)
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) rotateEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+			if err := f.Rotate(); err != nil {
+				Logger.Errorf("rotatingFile.rotateEvery() - Failed to rotate log file: %v", err)
+			}
+		}
+	}
+}
+
+func (f *rotatingFile) Close() error {
+	f.stopOnce.Do(func() { close(f.stop) })
+	return f.Logger.Close()
+}
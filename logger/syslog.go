@@ -0,0 +1,19 @@
+//go:build !windows && !plan9
+
+package logger
+
+import (
+	"io"
+	"log/syslog"
+
+	"github.com/sirupsen/logrus"
+	lSyslog "github.com/sirupsen/logrus/hooks/syslog"
+)
+
+func newSyslogHook(opts SyslogOptions) (logrus.Hook, io.Closer, error) {
+	hook, err := lSyslog.NewSyslogHook(opts.Network, opts.Address, syslog.LOG_INFO|syslog.LOG_DAEMON, opts.Tag)
+	if err != nil {
+		return nil, nil, err
+	}
+	return hook, hook.Writer, nil
+}
@@ -1,40 +1,313 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
+	"webapp/api/health"
+	"webapp/api/user"
 	"webapp/db"
+	applog "webapp/logger"
+	"webapp/metrics"
 	"webapp/router"
 	"webapp/setup"
-
-	"gorm.io/gorm"
+	"webapp/tracing"
 
 	"github.com/sirupsen/logrus"
 )
 
-var dbConnection *gorm.DB
-var err error
-
 var logger = logrus.New()
 
 func main() {
-	config := setup.GetDBConfig()
-	dbConnection, err = db.ConnectToDB(config.DSN)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+
+	// Catch SIGHUP (systemctl reload) before the slow startup work below,
+	// whose default action would kill the process. It is handled once the
+	// server runs, see reloadLoggingOnHangup.
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	config, err := setup.Load()
+	if err != nil {
+		logger.Fatalf("main() - %v", err)
+	}
+	if err := applog.Configure(logOptions(config.Log)); err != nil {
+		logger.Errorf("main() - Failed to configure logging, using stderr: %v", err)
+		if err := applog.SetLevel(config.Log.Level); err != nil {
+			logger.Errorf("main() - Failed to set log level: %v", err)
+		}
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		Exporter:     config.Tracing.Exporter,
+		OTLPEndpoint: config.Tracing.OTLPEndpoint,
+		OTLPInsecure: config.Tracing.OTLPInsecure,
+		SampleRatio:  config.Tracing.SampleRatio,
+	})
 	if err != nil {
-		logger.Error("main() - Database connection failed. Starting retry sequence...")
+		logger.Fatalf("main() - Failed to set up tracing: %v", err)
+	}
+
+	pubsubConfig := config.PubSub
+	user.VerificationTopic = pubsubConfig.VerificationTopic
+	user.PasswordResetTopic = pubsubConfig.PasswordResetTopic
+	verificationConfig := config.Verification
+	user.VerificationTokenTTL = verificationConfig.TokenTTL
+	user.ResendEmailLimit = verificationConfig.ResendEmailLimit
+	user.ResendIPLimit = verificationConfig.ResendIPLimit
+	user.ResendWindow = verificationConfig.ResendWindow
+
+	authConfig := config.Auth
+	user.AccessTokenTTL = authConfig.AccessTokenTTL
+	user.RefreshTokenTTL = authConfig.RefreshTokenTTL
+	user.PasswordResetTokenTTL = authConfig.PasswordResetTTL
+	user.AccountDeletionGracePeriod = authConfig.AccountDeletionGracePeriod
+	user.Hasher = passwordHasher(authConfig)
+	user.PasswordRules = user.PasswordPolicy{
+		MinLength:  authConfig.PasswordMinLength,
+		MaxBytes:   authConfig.PasswordMaxBytes,
+		MinClasses: authConfig.PasswordMinClasses,
+	}
+	if authConfig.BreachedPasswordFile != "" {
+		breached, err := user.OpenBreachedList(authConfig.BreachedPasswordFile)
+		if err != nil {
+			logger.Fatalf("main() - Failed to open breached password list: %v", err)
+		}
+		defer breached.Close()
+		user.PasswordRules.Breached = breached
+	}
+	user.UsernameLockoutPolicy = user.LockoutPolicy{
+		FreeAttempts:    authConfig.LockoutFreeAttempts,
+		MaxAttempts:     authConfig.LockoutMaxAttempts,
+		BaseDelay:       authConfig.LockoutBaseDelay,
+		LockoutDuration: authConfig.LockoutDuration,
+		ResetAfter:      authConfig.LockoutResetAfter,
+	}
+	user.IPLockoutPolicy = user.LockoutPolicy{
+		FreeAttempts:    authConfig.LockoutIPFreeAttempts,
+		MaxAttempts:     authConfig.LockoutIPMaxAttempts,
+		BaseDelay:       authConfig.LockoutBaseDelay,
+		LockoutDuration: authConfig.LockoutDuration,
+		ResetAfter:      authConfig.LockoutResetAfter,
+	}
+	if authConfig.TokenSigningKey != "" {
+		user.SetTokenSigningKey([]byte(authConfig.TokenSigningKey))
+	} else {
+		// Config validation only allows this for the memory and file backends.
+		logger.Warn("main() - TOKEN_SIGNING_KEY not set, using a per-process key; access tokens will not survive a restart")
+	}
+	publisher, err := newPublisher(pubsubConfig)
+	if err != nil {
+		logger.Fatalf("main() - Failed to create publisher: %v", err)
+	}
+
+	// Stop on SIGTERM from systemd or Ctrl-C.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	go reloadLoggingOnHangup(ctx, hangup)
+
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	var jobs sync.WaitGroup
+
+	provider := db.NewProvider(config.DB.DSN)
+	provider.Pool = db.PoolConfig{
+		MaxOpenConns:    config.DB.MaxOpenConns,
+		MaxIdleConns:    config.DB.MaxIdleConns,
+		ConnMaxLifetime: config.DB.ConnMaxLifetime,
+		ConnMaxIdleTime: config.DB.ConnMaxIdleTime,
+	}
+	metrics.RegisterDBStats(provider)
+	// Tracked by jobs, so a connection established during shutdown is
+	// handed over before provider.Close.
+	jobs.Add(1)
+	go func() {
+		defer jobs.Done()
+		if err := provider.Connect(jobsCtx); err != nil {
+			logger.Errorf("main() - Gave up connecting to database: %v", err)
+		}
+	}()
+	startBackgroundJobs(jobsCtx, &jobs, provider, publisher)
+
+	serverConfig := config.Server
+	health.CheckTimeout = serverConfig.HealthCheckTimeout
+	srv := &http.Server{
+		Addr:              ":" + serverConfig.Port,
+		Handler:           router.InitRouter(provider, publisher),
+		ReadTimeout:       serverConfig.ReadTimeout,
+		ReadHeaderTimeout: serverConfig.ReadHeaderTimeout,
+		WriteTimeout:      serverConfig.WriteTimeout,
+		IdleTimeout:       serverConfig.IdleTimeout,
+	}
+
+	// Metrics have their own listener, by default on loopback, so they are
+	// not exposed through the public port.
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/metrics", metrics.Handler())
+	metricsSrv := &http.Server{
+		Addr:              serverConfig.MetricsAddr,
+		Handler:           metricsMux,
+		ReadHeaderTimeout: serverConfig.ReadHeaderTimeout,
+	}
+
+	serveErr := make(chan error, 2)
+	go func() {
+		logger.Infof("main() - Listening on %s", srv.Addr)
+		serveErr <- srv.ListenAndServe()
+	}()
+	go func() {
+		logger.Infof("main() - Serving metrics on %s", metricsSrv.Addr)
+		serveErr <- metricsSrv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Errorf("main() - Server failed: %v", err)
+		}
+	case <-ctx.Done():
+		logger.Info("main() - Shutdown signal received, draining connections")
+	}
+	stop()
+
+	// Fail health checks first so the load balancer stops routing here,
+	// then let in-flight requests finish.
+	health.SetDraining(true)
+	time.Sleep(serverConfig.DrainDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), serverConfig.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Errorf("main() - Connections did not drain before the deadline: %v", err)
+	}
+	if err := metricsSrv.Shutdown(shutdownCtx); err != nil {
+		logger.Errorf("main() - Failed to stop metrics server: %v", err)
+	}
+
+	stopJobs()
+	jobs.Wait()
+
+	if err := publisher.Close(); err != nil {
+		logger.Errorf("main() - Failed to close publisher: %v", err)
+	}
+	if err := provider.Close(); err != nil {
+		logger.Errorf("main() - Failed to close database pool: %v", err)
+	}
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFlush()
+	if err := shutdownTracing(flushCtx); err != nil {
+		logger.Errorf("main() - Failed to flush traces: %v", err)
+	}
+	logger.Info("main() - Shutdown complete")
+	if err := applog.Close(); err != nil {
+		logger.Errorf("main() - Failed to close log sinks: %v", err)
+	}
+}
+
+// startBackgroundJobs starts the jobs that need a database connection once
+// the provider is ready. They stop when ctx is cancelled and are tracked by
+// jobs.
+func startBackgroundJobs(ctx context.Context, jobs *sync.WaitGroup, provider *db.Provider, publisher user.Publisher) {
+	jobs.Add(1)
+	go func() {
+		defer jobs.Done()
+		if _, err := provider.Wait(ctx); err != nil {
+			return
+		}
+
+		store := user.NewPostgresStore(provider)
+		jobs.Add(2)
 		go func() {
-			for {
-				time.Sleep(3 * time.Second)
-				dbConnection, err = db.ConnectToDB(config.DSN)
-				if err == nil {
-					// log.Println("Database connection established")
-					logger.Error("main() - Database connection established")
-					break
-				}
-				logger.Error("main() - Retrying to connect to database...")
-			}
+			defer jobs.Done()
+			user.NewOutboxRelay(store.Outbox, publisher).Run(ctx)
+		}()
+		go func() {
+			defer jobs.Done()
+			user.NewAccountPurger(store).Run(ctx)
 		}()
+	}()
+}
+
+func logOptions(config setup.LogConfig) applog.Options {
+	redact := make(map[string]applog.RedactAction, len(config.Redact))
+	for field, action := range config.Redact {
+		redact[field] = applog.RedactAction(action)
+	}
+	return applog.Options{
+		Level: config.Level,
+		Sinks: config.Sinks,
+		File: applog.FileOptions{
+			Path:           config.Path,
+			MaxSizeMB:      config.MaxSizeMB,
+			MaxBackups:     config.MaxBackups,
+			MaxAgeDays:     config.MaxAgeDays,
+			RotateInterval: config.RotateInterval,
+			Compress:       config.Compress,
+		},
+		Syslog: applog.SyslogOptions{
+			Network: config.SyslogNetwork,
+			Address: config.SyslogAddress,
+			Tag:     config.SyslogTag,
+		},
+		Redact:           redact,
+		RedactionHashKey: []byte(config.RedactionHashKey),
+	}
+}
+
+// passwordHasher returns the hasher selected by config, which has been
+// validated.
+func passwordHasher(config setup.AuthConfig) user.PasswordHasher {
+	if config.PasswordHash == "bcrypt" {
+		return user.BcryptHasher{Cost: config.BcryptCost}
 	}
+	return user.Argon2idHasher{
+		Memory:      uint32(config.Argon2MemoryKiB),
+		Iterations:  uint32(config.Argon2Iterations),
+		Parallelism: uint8(config.Argon2Parallelism),
+	}
+}
 
-	r := router.InitRouter(dbConnection)
-	r.Run()
+// reloadLoggingOnHangup re-reads the configuration whenever hangup receives
+// SIGHUP (systemctl reload) and applies its logging section, so the level can
+// be changed and log files reopened without a restart.
+func reloadLoggingOnHangup(ctx context.Context, hangup chan os.Signal) {
+	defer signal.Stop(hangup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			config, err := setup.Load()
+			if err != nil {
+				logger.Errorf("main() - SIGHUP: keeping current logging, %v", err)
+				continue
+			}
+			if err := applog.Configure(logOptions(config.Log)); err != nil {
+				logger.Errorf("main() - SIGHUP: failed to reconfigure logging: %v", err)
+				continue
+			}
+			applog.Logger.WithField("level", config.Log.Level).Info("main() - Reloaded logging configuration")
+		}
+	}
+}
+
+func newPublisher(config setup.PubSubConfig) (user.Publisher, error) {
+	switch config.Backend {
+	case "pubsub":
+		return user.NewPubSubPublisher(context.Background(), config.ProjectID)
+	case "memory":
+		return user.NewMemoryPublisher(), nil
+	case "file":
+		return user.NewFilePublisher(config.FilePath)
+	default:
+		return nil, fmt.Errorf("unknown publisher backend %q", config.Backend)
+	}
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+	"webapp/db"
+	"webapp/db/migrations"
+	"webapp/setup"
+)
+
+const migrateUsage = `usage: webapp migrate <command>
+
+commands:
+  up          apply all pending migrations
+  down [n] [--destroy-data]
+              roll back the last n migrations (default 1, "all" for every
+              one); rolling back the initial schema drops all data and
+              needs --destroy-data
+  status      list migrations and when they were applied`
+
+// runMigrate implements the "migrate" subcommand and returns the process
+// exit code.
+func runMigrate(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+
+	config, err := setup.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 1
+	}
+
+	conn, err := db.Open(config.DB.DSN)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 1
+	}
+	sqlDB, err := conn.DB()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+		return 1
+	}
+	defer sqlDB.Close()
+
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		applied, err := migrations.Up(ctx, sqlDB)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+			return 1
+		}
+		fmt.Printf("applied %d migrations\n", applied)
+
+	case "down":
+		steps := 1
+		destroyData := false
+		for _, arg := range args[1:] {
+			switch {
+			case arg == "--destroy-data":
+				destroyData = true
+			case arg == "all":
+				steps = -1
+			default:
+				if steps, err = strconv.Atoi(arg); err != nil || steps < 1 {
+					fmt.Fprintln(os.Stderr, migrateUsage)
+					return 2
+				}
+			}
+		}
+		rolledBack, err := migrations.Down(ctx, sqlDB, steps, destroyData)
+		if errors.Is(err, migrations.ErrDestructive) {
+			fmt.Fprintf(os.Stderr, "migrate: %v, nothing was rolled back; rerun with --destroy-data to drop it\n", err)
+			return 1
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+			return 1
+		}
+		fmt.Printf("rolled back %d migrations\n", rolledBack)
+
+	case "status":
+		statuses, err := migrations.List(ctx, sqlDB)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "migrate: %v\n", err)
+			return 1
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Printf("%04d  %-40s  %s\n", s.Version, s.Name, applied)
+		}
+
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		return 2
+	}
+	return 0
+}
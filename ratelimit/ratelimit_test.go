@@ -0,0 +1,32 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiterAllow(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	l := New(2, time.Minute)
+	l.now = func() time.Time { return now }
+
+	ok, _ := l.Allow("a@example.com")
+	assert.True(t, ok)
+	ok, _ = l.Allow("a@example.com")
+	assert.True(t, ok)
+
+	ok, retryAfter := l.Allow("a@example.com")
+	assert.False(t, ok)
+	assert.Equal(t, time.Minute, retryAfter)
+
+	// Keys are limited independently
+	ok, _ = l.Allow("b@example.com")
+	assert.True(t, ok)
+
+	// The window resets once it has elapsed
+	now = now.Add(time.Minute)
+	ok, _ = l.Allow("a@example.com")
+	assert.True(t, ok)
+}
@@ -1,47 +1,158 @@
 package router
 
 import (
+	"errors"
+	"math"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/gorm"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 
+	"webapp/api/apierror"
 	"webapp/api/health"
 	"webapp/api/user"
+	"webapp/db"
 	"webapp/logger"
+	"webapp/metrics"
+	"webapp/tracing"
 )
 
-func AuthenticationMiddleware(db *gorm.DB) gin.HandlerFunc {
+// AuthenticationMiddleware accepts either a Bearer access token issued by
+// user.LoginHandler or Basic credentials. Failed Basic logins are throttled
+// through store.Lockouts.
+func AuthenticationMiddleware(store *user.Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if authHeader := c.GetHeader("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+			userID, _, err := user.ParseAccessToken(strings.TrimPrefix(authHeader, "Bearer "))
+			if err != nil {
+				logger.FromContext(c).Error("AuthenticationMiddleware() - Invalid access token")
+				metrics.AuthAttempts.WithLabelValues("bearer", "invalid_token").Inc()
+				apierror.Abort(c, http.StatusUnauthorized, apierror.CodeInvalidToken, "Access token is invalid or expired")
+				return
+			}
+
+			// Tokens outlive account deletion, so make sure the account
+			// still exists.
+			account, err := store.Users.FindUserByID(c.Request.Context(), userID)
+			if err != nil && !errors.Is(err, user.ErrNotFound) {
+				logger.FromContext(c).Error("AuthenticationMiddleware() - Failed to look up token subject")
+				user.AbortStoreError(c, err)
+				return
+			}
+			if err != nil {
+				logger.FromContext(c).Error("AuthenticationMiddleware() - Access token subject no longer exists")
+				metrics.AuthAttempts.WithLabelValues("bearer", "unknown_subject").Inc()
+				apierror.Abort(c, http.StatusUnauthorized, apierror.CodeInvalidToken, "Access token is invalid or expired")
+				return
+			}
+
+			// The username may have changed since the token was issued.
+			c.Set("username", account.Username)
+			c.Set("userID", userID)
+			c.Set("authMethod", "bearer")
+			metrics.AuthAttempts.WithLabelValues("bearer", "success").Inc()
+			c.Next()
+			return
+		}
+
 		username, password, ok := c.Request.BasicAuth()
 		if !ok {
 			// fmt.Println("AuthenticationMiddleware() - Error: Basic authentication required")
-			logger.Logger.Error("AuthenticationMiddleware() - Basic authentication required")
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{})
+			logger.FromContext(c).Error("AuthenticationMiddleware() - Basic authentication required")
+			metrics.AuthAttempts.WithLabelValues("none", "missing_credentials").Inc()
+			apierror.Abort(c, http.StatusUnauthorized, apierror.CodeAuthRequired, "Authentication required")
 			return
 		}
+		username = user.NormalizeUsername(username)
 
-		if !user.ValidateCredentials(db, username, password) {
+		clientIP := c.ClientIP()
+		blockedFor, err := store.Lockouts.LoginBlockedFor(c.Request.Context(), username, clientIP)
+		if err != nil {
+			logger.FromContext(c).Error("AuthenticationMiddleware() - Failed to check login lockout")
+			user.AbortStoreError(c, err)
+			return
+		}
+		if blockedFor > 0 {
+			logger.FromContext(c).WithFields(logrus.Fields{
+				"username":    username,
+				"client_ip":   clientIP,
+				"retry_after": blockedFor.String(),
+			}).Warn("AuthenticationMiddleware() - Login attempt rejected, locked out")
+			metrics.AuthAttempts.WithLabelValues("basic", "locked_out").Inc()
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(blockedFor.Seconds()))))
+			apierror.Abort(c, http.StatusTooManyRequests, apierror.CodeAccountLocked, "Too many failed login attempts, try again later")
+			return
+		}
+
+		if !user.ValidateCredentials(c.Request.Context(), store.Users, username, password) {
 			// fmt.Println("AuthenticationMiddleware() - Error: Invalid credentials")
-			logger.Logger.Error("AuthenticationMiddleware() - Invalid credentials")
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{})
+			logger.FromContext(c).Error("AuthenticationMiddleware() - Invalid credentials")
+			metrics.AuthAttempts.WithLabelValues("basic", "invalid_credentials").Inc()
+			if err := store.Lockouts.RecordLoginFailure(c.Request.Context(), username, clientIP); err != nil {
+				logger.FromContext(c).Errorf("AuthenticationMiddleware() - Failed to record login failure: %v", err)
+			}
+			apierror.Abort(c, http.StatusUnauthorized, apierror.CodeInvalidCredentials, "Invalid username or password")
 			return
 		}
 
-		var user user.UserModel
-		if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		if err := store.Lockouts.RecordLoginSuccess(c.Request.Context(), username); err != nil {
+			logger.FromContext(c).Errorf("AuthenticationMiddleware() - Failed to reset login failures: %v", err)
+		}
+
+		account, err := store.Users.FindUserByUsername(c.Request.Context(), username)
+		if err != nil {
 			// fmt.Println("AuthenticationMiddleware() - Error: Failed to retrieve user ID details")
-			logger.Logger.Error("AuthenticationMiddleware() - Failed to retrieve user ID details")
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{})
+			logger.FromContext(c).Error("AuthenticationMiddleware() - Failed to retrieve user ID details")
+			user.AbortStoreError(c, err)
 			return
 		}
 
 		c.Set("username", username)
-		c.Set("userID", user.ID)
+		c.Set("userID", account.ID)
+		c.Set("authMethod", "basic")
+		metrics.AuthAttempts.WithLabelValues("basic", "success").Inc()
 		c.Next()
 	}
 }
 
+// RequestIDHeader carries the correlation ID of a request.
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID limits client supplied IDs to something safe to log.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestIDMiddleware accepts the client's X-Request-ID or generates one,
+// echoes it in the response and attaches it to the request context so that
+// logger.FromContext can annotate every entry of the request.
+func RequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(RequestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = uuid.NewString()
+		}
+
+		info := &logger.RequestInfo{
+			ID:     requestID,
+			Method: c.Request.Method,
+			Path:   c.Request.URL.Path,
+			Start:  time.Now(),
+		}
+		c.Request = c.Request.WithContext(logger.WithRequestInfo(c.Request.Context(), info))
+		c.Set("requestID", requestID)
+		c.Header(RequestIDHeader, requestID)
+
+		c.Next()
+
+		logger.FromContext(c).WithField("status", c.Writer.Status()).Info("RequestIDMiddleware() - Request completed")
+	}
+}
+
 func CacheControlMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Header("Cache-Control", "no-cache")
@@ -49,9 +160,17 @@ func CacheControlMiddleware() gin.HandlerFunc {
 	}
 }
 
-func InitRouter(db *gorm.DB) *gin.Engine {
+func InitRouter(database *db.Provider, publisher user.Publisher) *gin.Engine {
+	store := user.NewPostgresStore(database)
+
 	r := gin.Default()
+	// Let *gin.Context expose the request context, so handlers can pass c
+	// wherever a context.Context is expected, e.g. to logger.FromContext.
+	r.ContextWithFallback = true
 
+	r.Use(otelgin.Middleware(tracing.ServiceName))
+	r.Use(RequestIDMiddleware())
+	r.Use(metrics.Middleware())
 	r.Use(CacheControlMiddleware())
 
 	r.Use(func(c *gin.Context) {
@@ -60,23 +179,37 @@ func InitRouter(db *gorm.DB) *gin.Engine {
 		authHeader := c.GetHeader("Authorization")
 
 		nonAuthEndpoints := map[string]bool{
-			"/healthz": true,
-			"/v6/user": true,
-			"/verify":  true,
+			"/healthz":                        true,
+			"/livez":                          true,
+			"/readyz":                         true,
+			"/v6/user":                        true,
+			"/v6/user/resend-verification":    true,
+			"/v6/user/token/refresh":          true,
+			"/v6/user/password/reset":         true,
+			"/v6/user/password/reset/request": true,
+			"/verify":                         true,
 		}
 
 		if nonAuthEndpoints[path] && authHeader != "" {
 			// fmt.Println("Error: Non-authenticated endpoint should not include Authorization header")
-			logger.Logger.Error("InitRouter() -Non-authenticated endpoint should not include Authorization header")
-			c.AbortWithStatus(http.StatusBadRequest)
+			logger.FromContext(c).Error("InitRouter() -Non-authenticated endpoint should not include Authorization header")
+			apierror.Abort(c, http.StatusBadRequest, apierror.CodeAuthHeaderForbidden, "This endpoint does not accept an Authorization header")
 			return
 		}
 
 		allowedMethods := map[string][]string{
-			"/healthz":      {"GET"},
-			"/v6/user":      {"POST"},
-			"/v6/user/self": {"GET", "PUT"},
-			"/verify":       {"GET"},
+			"/healthz":                        {"GET"},
+			"/livez":                          {"GET"},
+			"/readyz":                         {"GET"},
+			"/v6/user":                        {"POST"},
+			"/v6/user/resend-verification":    {"POST"},
+			"/v6/user/login":                  {"POST"},
+			"/v6/user/token/refresh":          {"POST"},
+			"/v6/user/password/reset":         {"POST"},
+			"/v6/user/password/reset/request": {"POST"},
+			"/v6/user/self":                   {"GET", "PUT", "PATCH", "DELETE"},
+			"/v6/user/self/email":             {"POST"},
+			"/verify":                         {"GET"},
 		}
 
 		if methods, exists := allowedMethods[path]; exists {
@@ -88,7 +221,7 @@ func InitRouter(db *gorm.DB) *gin.Engine {
 				}
 			}
 			if !methodAllowed {
-				c.AbortWithStatus(http.StatusMethodNotAllowed)
+				apierror.Abort(c, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
 				return
 			}
 		}
@@ -96,52 +229,76 @@ func InitRouter(db *gorm.DB) *gin.Engine {
 	})
 
 	//Check DB health
-	r.GET("/healthz", health.HealthCheckHandler(db))
+	r.GET("/healthz", health.HealthCheckHandler(database))
+
+	//Liveness and readiness probes
+	readiness := health.NewReadiness(
+		health.DatabaseCheck(database),
+		health.MigrationsCheck(database),
+		health.PublisherCheck(publisher),
+	)
+	r.GET("/livez", health.LivenessHandler())
+	r.GET("/readyz", readiness.Handler())
 
 	//Create User
-	r.POST("/v6/user", user.CreateUserHandler(db))
+	r.POST("/v6/user", user.CreateUserHandler(store))
 
 	//Verify User
-	r.GET("/verify", user.VerifyUserHandler(db))
+	r.GET("/verify", user.VerifyUserHandler(store))
+
+	//Resend verification email
+	r.POST("/v6/user/resend-verification", user.ResendVerificationHandler(store))
+
+	//Password reset
+	r.POST("/v6/user/password/reset/request", user.RequestPasswordResetHandler(store))
+	r.POST("/v6/user/password/reset", user.ConfirmPasswordResetHandler(store))
+
+	//Exchange a refresh token for new tokens
+	r.POST("/v6/user/token/refresh", user.RefreshTokenHandler(store))
 
 	authGroup := r.Group("/")
-	authGroup.Use(AuthenticationMiddleware(db))
+	authGroup.Use(AuthenticationMiddleware(store))
 	{
+		authGroup.POST("/v6/user/login", user.LoginHandler(store))
+		authGroup.DELETE("/v6/user/self", user.DeleteUserHandler(store))
+
 		// Routes that also require email verification
 		verifiedGroup := authGroup.Group("/")
-		verifiedGroup.Use(EmailVerificationMiddleware(db))
+		verifiedGroup.Use(EmailVerificationMiddleware(store))
 		{
-			verifiedGroup.GET("/v6/user/self", user.GetUserDetails(db))
-			verifiedGroup.PUT("/v6/user/self", user.UpdateUserHandler(db))
+			verifiedGroup.GET("/v6/user/self", user.GetUserDetails(store))
+			verifiedGroup.PUT("/v6/user/self", user.UpdateUserHandler(store))
+			verifiedGroup.PATCH("/v6/user/self", user.PatchUserHandler(store))
+			verifiedGroup.POST("/v6/user/self/email", user.RequestEmailChangeHandler(store))
 		}
 	}
 
 	r.NoRoute(func(c *gin.Context) {
-		c.JSON(http.StatusNotFound, gin.H{})
+		apierror.Abort(c, http.StatusNotFound, apierror.CodeNotFound, "Resource not found")
 	})
 
 	return r
 }
 
-func EmailVerificationMiddleware(db *gorm.DB) gin.HandlerFunc {
+func EmailVerificationMiddleware(store *user.Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		userID, exists := c.Get("userID")
 		if !exists {
-			logger.Logger.Error("EmailVerificationMiddleware() - User ID not found in context")
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			logger.FromContext(c).Error("EmailVerificationMiddleware() - User ID not found in context")
+			apierror.Abort(c, http.StatusUnauthorized, apierror.CodeAuthRequired, "Authentication required")
 			return
 		}
 
-		var user user.UserModel
-		if err := db.First(&user, "id = ?", userID).Error; err != nil {
-			logger.Logger.Error("EmailVerificationMiddleware() - Failed to retrieve user")
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user"})
+		account, err := store.Users.FindUserByID(c.Request.Context(), userID.(uuid.UUID))
+		if err != nil {
+			logger.FromContext(c).Error("EmailVerificationMiddleware() - Failed to retrieve user")
+			user.AbortStoreError(c, err)
 			return
 		}
 
-		if !user.IsVerified {
-			logger.Logger.Error("EmailVerificationMiddleware() - User's email address is not verified")
-			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Email address is not verified"})
+		if !account.IsVerified {
+			logger.FromContext(c).Error("EmailVerificationMiddleware() - User's email address is not verified")
+			apierror.Abort(c, http.StatusForbidden, apierror.CodeEmailNotVerified, "Email address is not verified")
 			return
 		}
 
@@ -0,0 +1,134 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"webapp/api/apierror"
+	"webapp/api/user"
+	"webapp/db"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestRouter(t *testing.T) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	return InitRouter(db.NewProvider(""), user.NewMemoryPublisher())
+}
+
+func serve(engine *gin.Engine, method, target string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	return w
+}
+
+func TestInitRouterRegistersEmailChange(t *testing.T) {
+	engine := newTestRouter(t)
+
+	registered := false
+	for _, route := range engine.Routes() {
+		if route.Method == http.MethodPost && route.Path == "/v6/user/self/email" {
+			registered = true
+		}
+	}
+	assert.True(t, registered, "POST /v6/user/self/email is not routed")
+
+	w := serve(engine, http.MethodPost, "/v6/user/self/email")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), apierror.CodeAuthRequired)
+
+	w = serve(engine, http.MethodGet, "/v6/user/self/email")
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestInitRouterDoesNotServeMetrics(t *testing.T) {
+	w := serve(newTestRouter(t), http.MethodGet, "/metrics")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// newLockoutEngine guards a route with AuthenticationMiddleware over a
+// memory store holding jane@example.com, whose failed logins are throttled
+// after the first one.
+func newLockoutEngine(t *testing.T) *gin.Engine {
+	hasher, usernamePolicy := user.Hasher, user.UsernameLockoutPolicy
+	t.Cleanup(func() { user.Hasher, user.UsernameLockoutPolicy = hasher, usernamePolicy })
+	user.Hasher = user.BcryptHasher{Cost: bcrypt.MinCost}
+	user.UsernameLockoutPolicy = user.LockoutPolicy{
+		FreeAttempts:    1,
+		MaxAttempts:     3,
+		BaseDelay:       time.Minute,
+		LockoutDuration: time.Hour,
+		ResetAfter:      time.Hour,
+	}
+
+	store := user.NewMemoryStore()
+	password, err := user.Hasher.Hash("s3cret-password")
+	assert.NoError(t, err)
+	account := &user.UserModel{ID: uuid.New(), Username: "jane@example.com", Password: password, IsVerified: true}
+	assert.NoError(t, store.Users.CreateUser(context.Background(), account, &user.EmailVerification{Email: account.Username}, &user.OutboxMessage{ID: uuid.New()}))
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.GET("/protected", AuthenticationMiddleware(store), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+	return engine
+}
+
+func login(engine *gin.Engine, password string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/protected", nil)
+	req.SetBasicAuth("jane@example.com", password)
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, req)
+	return w
+}
+
+func TestAuthenticationMiddlewareLocksOutAfterFailures(t *testing.T) {
+	engine := newLockoutEngine(t)
+
+	assert.Equal(t, http.StatusUnauthorized, login(engine, "wrong").Code)
+	assert.Equal(t, http.StatusUnauthorized, login(engine, "wrong").Code)
+
+	// The second failure blocks the username, even for the right password.
+	w := login(engine, "s3cret-password")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), apierror.CodeAccountLocked)
+	retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	assert.NoError(t, err)
+	assert.InDelta(t, 60, retryAfter, 1)
+}
+
+func TestAuthenticationMiddlewareResetsFailuresOnSuccess(t *testing.T) {
+	engine := newLockoutEngine(t)
+
+	assert.Equal(t, http.StatusUnauthorized, login(engine, "wrong").Code)
+	assert.Equal(t, http.StatusNoContent, login(engine, "s3cret-password").Code)
+
+	// Without the reset this would be the second failure in a row.
+	assert.Equal(t, http.StatusUnauthorized, login(engine, "wrong").Code)
+	assert.Equal(t, http.StatusNoContent, login(engine, "s3cret-password").Code)
+}
+
+func TestAuthenticationMiddlewareAnswersWithErrorEnvelope(t *testing.T) {
+	w := serve(newTestRouter(t), http.MethodGet, "/v6/user/self")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	var response apierror.Response
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, apierror.Response{Code: apierror.CodeAuthRequired, Message: "Authentication required"}, response)
+
+	w = login(newLockoutEngine(t), "wrong")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	response = apierror.Response{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, apierror.CodeInvalidCredentials, response.Code)
+	assert.NotEmpty(t, response.Message)
+	assert.Empty(t, response.Details)
+}
@@ -1,22 +1,618 @@
 package setup
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
 )
 
+// Config is the complete application configuration. It is assembled from
+// built-in defaults, an optional YAML file and environment variables, in
+// increasing order of precedence.
+type Config struct {
+	DB           DBConfig           `yaml:"db"`
+	PubSub       PubSubConfig       `yaml:"pubsub"`
+	Log          LogConfig          `yaml:"log"`
+	Server       ServerConfig       `yaml:"server"`
+	Auth         AuthConfig         `yaml:"auth"`
+	Verification VerificationConfig `yaml:"verification"`
+	Tracing      TracingConfig      `yaml:"tracing"`
+}
+
 type DBConfig struct {
-	DSN string
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Name     string `yaml:"name"`
+	SSLMode  string `yaml:"sslmode"`
+
+	// Connection pool limits, see database/sql. Zero keeps the database/sql
+	// default.
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time"`
+
+	// DSN is built from the fields above.
+	DSN string `yaml:"-"`
+}
+
+type PubSubConfig struct {
+	// Backend selects the publisher implementation: pubsub, memory or file.
+	Backend            string `yaml:"backend"`
+	ProjectID          string `yaml:"project_id"`
+	VerificationTopic  string `yaml:"verification_topic"`
+	PasswordResetTopic string `yaml:"password_reset_topic"`
+	// FilePath is where the file backend appends messages.
+	FilePath string `yaml:"file_path"`
+}
+
+type LogConfig struct {
+	Level string `yaml:"level"`
+	// Sinks lists the outputs: file, stdout, stderr and syslog.
+	Sinks []string `yaml:"sinks"`
+
+	// File sink. It is rotated past MaxSizeMB and every RotateInterval, if
+	// set, keeping MaxBackups files for at most MaxAgeDays.
+	Path           string        `yaml:"path"`
+	MaxSizeMB      int           `yaml:"max_size_mb"`
+	MaxBackups     int           `yaml:"max_backups"`
+	MaxAgeDays     int           `yaml:"max_age_days"`
+	RotateInterval time.Duration `yaml:"rotate_interval"`
+	Compress       bool          `yaml:"compress"`
+
+	// Syslog sink; empty network and address use the local daemon.
+	SyslogNetwork string `yaml:"syslog_network"`
+	SyslogAddress string `yaml:"syslog_address"`
+	SyslogTag     string `yaml:"syslog_tag"`
+
+	// Redact overrides the logger's default redaction policy per field
+	// name with mask, hash, drop or keep.
+	Redact map[string]string `yaml:"redact"`
+	// RedactionHashKey keys hashed field values, so they can't be reversed
+	// by hashing guesses.
+	RedactionHashKey string `yaml:"redaction_hash_key"`
+}
+
+type TracingConfig struct {
+	// Exporter is none, stdout or otlp.
+	Exporter string `yaml:"exporter"`
+	// OTLPEndpoint is the host:port of an OTLP/HTTP collector. When empty the
+	// standard OTEL_EXPORTER_OTLP_* variables apply.
+	OTLPEndpoint string  `yaml:"otlp_endpoint"`
+	OTLPInsecure bool    `yaml:"otlp_insecure"`
+	SampleRatio  float64 `yaml:"sample_ratio"`
+}
+
+type VerificationConfig struct {
+	TokenTTL time.Duration `yaml:"token_ttl"`
+	// Resend limits apply per email address and per client IP within
+	// ResendWindow.
+	ResendEmailLimit int           `yaml:"resend_email_limit"`
+	ResendIPLimit    int           `yaml:"resend_ip_limit"`
+	ResendWindow     time.Duration `yaml:"resend_window"`
+}
+
+// MinTokenSigningKeyLen is the shortest accepted auth.token_signing_key, the
+// output size of the HS256 hash.
+const MinTokenSigningKeyLen = 32
+
+type AuthConfig struct {
+	// TokenSigningKey signs access tokens. It must be shared by all
+	// instances and is required for the pubsub backend; with the memory and
+	// file backends an empty key means a random per-process key.
+	TokenSigningKey  string        `yaml:"token_signing_key"`
+	AccessTokenTTL   time.Duration `yaml:"access_token_ttl"`
+	RefreshTokenTTL  time.Duration `yaml:"refresh_token_ttl"`
+	PasswordResetTTL time.Duration `yaml:"password_reset_token_ttl"`
+	// AccountDeletionGracePeriod is how long a deleted account keeps its
+	// username before it is purged.
+	AccountDeletionGracePeriod time.Duration `yaml:"account_deletion_grace_period"`
+
+	// PasswordHash is the algorithm new passwords are hashed with, argon2id
+	// or bcrypt. Hashes made with another algorithm or cost are upgraded on
+	// the next successful login.
+	PasswordHash      string `yaml:"password_hash"`
+	BcryptCost        int    `yaml:"bcrypt_cost"`
+	Argon2MemoryKiB   int    `yaml:"argon2_memory_kib"`
+	Argon2Iterations  int    `yaml:"argon2_iterations"`
+	Argon2Parallelism int    `yaml:"argon2_parallelism"`
+
+	// Password strength policy, see user.PasswordPolicy.
+	PasswordMinLength  int `yaml:"password_min_length"`
+	PasswordMaxBytes   int `yaml:"password_max_bytes"`
+	PasswordMinClasses int `yaml:"password_min_classes"`
+	// BreachedPasswordFile is an optional sorted Pwned Passwords SHA-1 list,
+	// see user.BreachedList.
+	BreachedPasswordFile string `yaml:"breached_password_file"`
+
+	// Failed login throttling, see user.LockoutPolicy.
+	LockoutFreeAttempts   int           `yaml:"lockout_free_attempts"`
+	LockoutMaxAttempts    int           `yaml:"lockout_max_attempts"`
+	LockoutIPFreeAttempts int           `yaml:"lockout_ip_free_attempts"`
+	LockoutIPMaxAttempts  int           `yaml:"lockout_ip_max_attempts"`
+	LockoutBaseDelay      time.Duration `yaml:"lockout_base_delay"`
+	LockoutDuration       time.Duration `yaml:"lockout_duration"`
+	LockoutResetAfter     time.Duration `yaml:"lockout_reset_after"`
+}
+
+type ServerConfig struct {
+	Port string `yaml:"port"`
+	// MetricsAddr is the host:port of the separate listener serving
+	// /metrics. It defaults to loopback so the metrics stay off the public
+	// port and are only reachable by a local scraper.
+	MetricsAddr       string        `yaml:"metrics_addr"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	// DrainDelay is how long /healthz reports failure before the server
+	// stops accepting connections, giving the load balancer time to notice.
+	DrainDelay time.Duration `yaml:"drain_delay"`
+	// ShutdownTimeout bounds how long in-flight requests may take to finish.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// HealthCheckTimeout bounds each dependency check behind /readyz.
+	HealthCheckTimeout time.Duration `yaml:"health_check_timeout"`
+}
+
+// ValidationError lists every problem found while loading the configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// Default returns the configuration used when nothing is overridden.
+func Default() Config {
+	return Config{
+		DB: DBConfig{
+			SSLMode:      "disable",
+			MaxIdleConns: 2,
+		},
+		PubSub: PubSubConfig{
+			Backend:            "pubsub",
+			ProjectID:          "csye6225-dev-414220",
+			VerificationTopic:  "verify_email",
+			PasswordResetTopic: "password_reset",
+			FilePath:           "messages.jsonl",
+		},
+		Log: LogConfig{
+			Level:          "info",
+			Sinks:          []string{"file"},
+			Path:           "/var/log/webapp/webapp.log",
+			MaxSizeMB:      100,
+			MaxBackups:     7,
+			MaxAgeDays:     30,
+			RotateInterval: 24 * time.Hour,
+			SyslogTag:      "webapp",
+		},
+		Server: ServerConfig{
+			Port:              "8080",
+			MetricsAddr:       "127.0.0.1:9090",
+			ReadTimeout:       15 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       60 * time.Second,
+			DrainDelay:        5 * time.Second,
+			ShutdownTimeout:   20 * time.Second,
+
+			HealthCheckTimeout: 2 * time.Second,
+		},
+		Auth: AuthConfig{
+			AccessTokenTTL:   15 * time.Minute,
+			RefreshTokenTTL:  7 * 24 * time.Hour,
+			PasswordResetTTL: 15 * time.Minute,
+
+			AccountDeletionGracePeriod: 30 * 24 * time.Hour,
+
+			PasswordHash:      "argon2id",
+			BcryptCost:        14,
+			Argon2MemoryKiB:   19 * 1024,
+			Argon2Iterations:  2,
+			Argon2Parallelism: 1,
+
+			PasswordMinLength:  8,
+			PasswordMaxBytes:   72,
+			PasswordMinClasses: 2,
+
+			LockoutFreeAttempts:   3,
+			LockoutMaxAttempts:    10,
+			LockoutIPFreeAttempts: 20,
+			LockoutIPMaxAttempts:  100,
+			LockoutBaseDelay:      time.Second,
+			LockoutDuration:       15 * time.Minute,
+			LockoutResetAfter:     time.Hour,
+		},
+		Verification: VerificationConfig{
+			TokenTTL:         2 * time.Minute,
+			ResendEmailLimit: 3,
+			ResendIPLimit:    10,
+			ResendWindow:     time.Hour,
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			SampleRatio: 1,
+		},
+	}
+}
+
+// Load builds the configuration from the defaults, the YAML file named by
+// CONFIG_FILE if set, and environment variables, then validates it.
+func Load() (Config, error) {
+	return LoadFile(os.Getenv("CONFIG_FILE"))
+}
+
+// LoadFile is Load with an explicit YAML file path. An empty path skips the
+// file.
+func LoadFile(path string) (Config, error) {
+	config := Default()
+	if path != "" {
+		if err := readFile(path, &config); err != nil {
+			return Config{}, fmt.Errorf("reading config file %s: %w", path, err)
+		}
+	}
+
+	env := &envReader{}
+	env.apply(&config)
+	problems := append(env.problems, config.validate()...)
+	if len(problems) > 0 {
+		return Config{}, &ValidationError{Problems: problems}
+	}
+
+	config.DB.DSN = config.DB.dsn()
+	return config, nil
 }
 
+func readFile(path string, config *Config) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// GetDBConfig returns the database settings from the environment alone.
 func GetDBConfig() DBConfig {
-	//GORM
-	dbHost := os.Getenv("DB_HOST")
-	dbUser := os.Getenv("DB_USER")
-	dbPassword := os.Getenv("DB_PASSWORD")
-	dbName := os.Getenv("DB_NAME")
+	config := Default()
+	env := &envReader{}
+	env.applyDB(&config.DB)
+	config.DB.DSN = config.DB.dsn()
+	return config.DB
+}
+
+func (c DBConfig) dsn() string {
+	dsn := "host=" + dsnValue(c.Host) + " user=" + dsnValue(c.User) + " dbname=" + dsnValue(c.Name) + " sslmode=" + dsnValue(c.SSLMode) + " password=" + dsnValue(c.Password)
+	if c.Port != 0 {
+		dsn += " port=" + strconv.Itoa(c.Port)
+	}
+	return dsn
+}
+
+// dsnValue quotes v when it would otherwise break the key=value DSN format.
+func dsnValue(v string) string {
+	if !strings.ContainsAny(v, ` '\`) {
+		return v
+	}
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `'`, `\'`)
+	return "'" + v + "'"
+}
+
+// envReader overrides configuration fields from environment variables and
+// records values that cannot be parsed.
+type envReader struct {
+	problems []string
+}
+
+func (e *envReader) apply(c *Config) {
+	e.applyDB(&c.DB)
+
+	e.string(&c.PubSub.Backend, "PUBLISHER_BACKEND")
+	// SKIP_PUBSUB predates PUBLISHER_BACKEND and is still honoured.
+	if os.Getenv("SKIP_PUBSUB") == "true" {
+		c.PubSub.Backend = "memory"
+	}
+	e.string(&c.PubSub.ProjectID, "PUBSUB_PROJECT_ID")
+	e.string(&c.PubSub.VerificationTopic, "PUBSUB_VERIFICATION_TOPIC")
+	e.string(&c.PubSub.PasswordResetTopic, "PUBSUB_PASSWORD_RESET_TOPIC")
+	e.string(&c.PubSub.FilePath, "PUBLISHER_FILE_PATH")
+
+	e.string(&c.Log.Level, "LOG_LEVEL")
+	e.list(&c.Log.Sinks, "LOG_SINKS")
+	e.string(&c.Log.Path, "LOG_PATH")
+	e.int(&c.Log.MaxSizeMB, "LOG_MAX_SIZE_MB")
+	e.int(&c.Log.MaxBackups, "LOG_MAX_BACKUPS")
+	e.int(&c.Log.MaxAgeDays, "LOG_MAX_AGE_DAYS")
+	e.duration(&c.Log.RotateInterval, "LOG_ROTATE_INTERVAL")
+	e.bool(&c.Log.Compress, "LOG_COMPRESS")
+	e.string(&c.Log.SyslogNetwork, "LOG_SYSLOG_NETWORK")
+	e.string(&c.Log.SyslogAddress, "LOG_SYSLOG_ADDRESS")
+	e.string(&c.Log.SyslogTag, "LOG_SYSLOG_TAG")
+	e.mapping(&c.Log.Redact, "LOG_REDACT")
+	e.string(&c.Log.RedactionHashKey, "LOG_REDACTION_HASH_KEY")
+
+	e.string(&c.Server.Port, "PORT")
+	e.string(&c.Server.MetricsAddr, "METRICS_ADDR")
+	e.duration(&c.Server.ReadTimeout, "HTTP_READ_TIMEOUT")
+	e.duration(&c.Server.ReadHeaderTimeout, "HTTP_READ_HEADER_TIMEOUT")
+	e.duration(&c.Server.WriteTimeout, "HTTP_WRITE_TIMEOUT")
+	e.duration(&c.Server.IdleTimeout, "HTTP_IDLE_TIMEOUT")
+	e.duration(&c.Server.DrainDelay, "HTTP_DRAIN_DELAY")
+	e.duration(&c.Server.ShutdownTimeout, "HTTP_SHUTDOWN_TIMEOUT")
+	e.duration(&c.Server.HealthCheckTimeout, "HEALTH_CHECK_TIMEOUT")
+
+	e.string(&c.Auth.TokenSigningKey, "TOKEN_SIGNING_KEY")
+	e.duration(&c.Auth.AccessTokenTTL, "ACCESS_TOKEN_TTL")
+	e.duration(&c.Auth.RefreshTokenTTL, "REFRESH_TOKEN_TTL")
+	e.duration(&c.Auth.PasswordResetTTL, "PASSWORD_RESET_TOKEN_TTL")
+	e.duration(&c.Auth.AccountDeletionGracePeriod, "ACCOUNT_DELETION_GRACE_PERIOD")
+	e.string(&c.Auth.PasswordHash, "PASSWORD_HASH")
+	e.int(&c.Auth.BcryptCost, "BCRYPT_COST")
+	e.int(&c.Auth.Argon2MemoryKiB, "ARGON2_MEMORY_KIB")
+	e.int(&c.Auth.Argon2Iterations, "ARGON2_ITERATIONS")
+	e.int(&c.Auth.Argon2Parallelism, "ARGON2_PARALLELISM")
+	e.int(&c.Auth.PasswordMinLength, "PASSWORD_MIN_LENGTH")
+	e.int(&c.Auth.PasswordMaxBytes, "PASSWORD_MAX_BYTES")
+	e.int(&c.Auth.PasswordMinClasses, "PASSWORD_MIN_CLASSES")
+	e.string(&c.Auth.BreachedPasswordFile, "BREACHED_PASSWORD_FILE")
+	e.int(&c.Auth.LockoutFreeAttempts, "LOGIN_LOCKOUT_FREE_ATTEMPTS")
+	e.int(&c.Auth.LockoutMaxAttempts, "LOGIN_LOCKOUT_MAX_ATTEMPTS")
+	e.int(&c.Auth.LockoutIPFreeAttempts, "LOGIN_LOCKOUT_IP_FREE_ATTEMPTS")
+	e.int(&c.Auth.LockoutIPMaxAttempts, "LOGIN_LOCKOUT_IP_MAX_ATTEMPTS")
+	e.duration(&c.Auth.LockoutBaseDelay, "LOGIN_LOCKOUT_BASE_DELAY")
+	e.duration(&c.Auth.LockoutDuration, "LOGIN_LOCKOUT_DURATION")
+	e.duration(&c.Auth.LockoutResetAfter, "LOGIN_LOCKOUT_RESET_AFTER")
+
+	e.duration(&c.Verification.TokenTTL, "VERIFICATION_TOKEN_TTL")
+	e.int(&c.Verification.ResendEmailLimit, "VERIFICATION_RESEND_EMAIL_LIMIT")
+	e.int(&c.Verification.ResendIPLimit, "VERIFICATION_RESEND_IP_LIMIT")
+	e.duration(&c.Verification.ResendWindow, "VERIFICATION_RESEND_WINDOW")
+
+	e.string(&c.Tracing.Exporter, "TRACING_EXPORTER")
+	e.string(&c.Tracing.OTLPEndpoint, "TRACING_OTLP_ENDPOINT")
+	e.bool(&c.Tracing.OTLPInsecure, "TRACING_OTLP_INSECURE")
+	e.float(&c.Tracing.SampleRatio, "TRACING_SAMPLE_RATIO")
+}
+
+func (e *envReader) applyDB(c *DBConfig) {
+	e.string(&c.Host, "DB_HOST")
+	e.int(&c.Port, "DB_PORT")
+	e.string(&c.User, "DB_USER")
+	e.string(&c.Password, "DB_PASSWORD")
+	e.string(&c.Name, "DB_NAME")
+	e.string(&c.SSLMode, "DB_SSLMODE")
+	e.int(&c.MaxOpenConns, "DB_MAX_OPEN_CONNS")
+	e.int(&c.MaxIdleConns, "DB_MAX_IDLE_CONNS")
+	e.duration(&c.ConnMaxLifetime, "DB_CONN_MAX_LIFETIME")
+	e.duration(&c.ConnMaxIdleTime, "DB_CONN_MAX_IDLE_TIME")
+}
+
+func (e *envReader) string(dst *string, key string) {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		*dst = value
+	}
+}
+
+// list reads a comma separated list.
+func (e *envReader) list(dst *[]string, key string) {
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	*dst = items
+}
+
+// mapping reads comma separated key=value pairs and merges them into dst.
+func (e *envReader) mapping(dst *map[string]string, key string) {
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+	if *dst == nil {
+		*dst = make(map[string]string)
+	}
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			e.problems = append(e.problems, fmt.Sprintf("%s: %q is not a key=value pair", key, pair))
+			continue
+		}
+		(*dst)[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+}
+
+func (e *envReader) int(dst *int, key string) {
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		e.problems = append(e.problems, fmt.Sprintf("%s: %q is not an integer", key, value))
+		return
+	}
+	*dst = n
+}
+
+func (e *envReader) bool(dst *bool, key string) {
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		e.problems = append(e.problems, fmt.Sprintf("%s: %q is not a boolean", key, value))
+		return
+	}
+	*dst = b
+}
+
+func (e *envReader) float(dst *float64, key string) {
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		e.problems = append(e.problems, fmt.Sprintf("%s: %q is not a number", key, value))
+		return
+	}
+	*dst = f
+}
+
+func (e *envReader) duration(dst *time.Duration, key string) {
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		e.problems = append(e.problems, fmt.Sprintf("%s: %q is not a duration", key, value))
+		return
+	}
+	*dst = d
+}
+
+func (c Config) validate() []string {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(c.DB.Host != "", "db.host (DB_HOST) is required")
+	check(c.DB.User != "", "db.user (DB_USER) is required")
+	check(c.DB.Name != "", "db.name (DB_NAME) is required")
+	check(c.DB.Port >= 0 && c.DB.Port <= 65535, "db.port %d is out of range", c.DB.Port)
+	switch c.DB.SSLMode {
+	case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		check(false, "db.sslmode %q is not a valid sslmode", c.DB.SSLMode)
+	}
+	check(c.DB.MaxOpenConns >= 0, "db.max_open_conns must not be negative")
+	check(c.DB.MaxIdleConns >= 0, "db.max_idle_conns must not be negative")
+	check(c.DB.MaxOpenConns == 0 || c.DB.MaxIdleConns <= c.DB.MaxOpenConns, "db.max_idle_conns must not exceed db.max_open_conns")
+	check(c.DB.ConnMaxLifetime >= 0, "db.conn_max_lifetime must not be negative")
+	check(c.DB.ConnMaxIdleTime >= 0, "db.conn_max_idle_time must not be negative")
+
+	switch c.PubSub.Backend {
+	case "pubsub":
+		check(c.PubSub.ProjectID != "", "pubsub.project_id is required for the pubsub backend")
+	case "file":
+		check(c.PubSub.FilePath != "", "pubsub.file_path is required for the file backend")
+	case "memory":
+	default:
+		check(false, "pubsub.backend %q must be pubsub, memory or file", c.PubSub.Backend)
+	}
+	check(c.PubSub.VerificationTopic != "", "pubsub.verification_topic is required")
+	check(c.PubSub.PasswordResetTopic != "", "pubsub.password_reset_topic is required")
+
+	if _, err := logrus.ParseLevel(c.Log.Level); err != nil {
+		check(false, "log.level %q is not a valid level", c.Log.Level)
+	}
+	for _, sink := range c.Log.Sinks {
+		switch sink {
+		case "file":
+			check(c.Log.Path != "", "log.path is required for the file sink")
+		case "stdout", "stderr", "syslog":
+		default:
+			check(false, "log.sinks: %q must be file, stdout, stderr or syslog", sink)
+		}
+	}
+	check(c.Log.MaxSizeMB >= 0, "log.max_size_mb must not be negative")
+	check(c.Log.MaxBackups >= 0, "log.max_backups must not be negative")
+	check(c.Log.MaxAgeDays >= 0, "log.max_age_days must not be negative")
+	check(c.Log.RotateInterval >= 0, "log.rotate_interval must not be negative")
+	for field, action := range c.Log.Redact {
+		switch action {
+		case "mask", "hash", "drop", "keep":
+		default:
+			check(false, "log.redact: %q for field %q must be mask, hash, drop or keep", action, field)
+		}
+	}
+
+	port, err := strconv.Atoi(c.Server.Port)
+	check(err == nil && port > 0 && port <= 65535, "server.port %q is not a valid port", c.Server.Port)
+	_, metricsPort, err := net.SplitHostPort(c.Server.MetricsAddr)
+	if err == nil {
+		port, err = strconv.Atoi(metricsPort)
+	}
+	check(err == nil && port > 0 && port <= 65535, "server.metrics_addr %q is not a valid host:port", c.Server.MetricsAddr)
+	check(c.Server.ReadTimeout >= 0, "server.read_timeout must not be negative")
+	check(c.Server.ReadHeaderTimeout >= 0, "server.read_header_timeout must not be negative")
+	check(c.Server.WriteTimeout >= 0, "server.write_timeout must not be negative")
+	check(c.Server.IdleTimeout >= 0, "server.idle_timeout must not be negative")
+	check(c.Server.DrainDelay >= 0, "server.drain_delay must not be negative")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+	check(c.Server.HealthCheckTimeout > 0, "server.health_check_timeout must be positive")
+
+	if c.Auth.TokenSigningKey == "" {
+		check(c.PubSub.Backend != "pubsub", "auth.token_signing_key (TOKEN_SIGNING_KEY) is required for the pubsub backend")
+	} else {
+		check(len(c.Auth.TokenSigningKey) >= MinTokenSigningKeyLen, "auth.token_signing_key (TOKEN_SIGNING_KEY) must be at least %d bytes", MinTokenSigningKeyLen)
+	}
+	check(c.Auth.AccessTokenTTL > 0, "auth.access_token_ttl must be positive")
+	check(c.Auth.RefreshTokenTTL > 0, "auth.refresh_token_ttl must be positive")
+	check(c.Auth.PasswordResetTTL > 0, "auth.password_reset_token_ttl must be positive")
+	check(c.Auth.AccountDeletionGracePeriod >= 0, "auth.account_deletion_grace_period must not be negative")
+	check(c.Auth.PasswordHash == "argon2id" || c.Auth.PasswordHash == "bcrypt", "auth.password_hash %q must be argon2id or bcrypt", c.Auth.PasswordHash)
+	// The bounds of golang.org/x/crypto/bcrypt.
+	check(c.Auth.BcryptCost >= 4 && c.Auth.BcryptCost <= 31, "auth.bcrypt_cost %d must be between 4 and 31", c.Auth.BcryptCost)
+	// Argon2 needs at least 8 KiB of memory per lane.
+	check(c.Auth.Argon2Parallelism >= 1 && c.Auth.Argon2Parallelism <= 255, "auth.argon2_parallelism %d must be between 1 and 255", c.Auth.Argon2Parallelism)
+	check(c.Auth.Argon2MemoryKiB >= 8*c.Auth.Argon2Parallelism && c.Auth.Argon2MemoryKiB <= 4*1024*1024, "auth.argon2_memory_kib %d must be between 8 per lane and 4194304", c.Auth.Argon2MemoryKiB)
+	check(c.Auth.Argon2Iterations >= 1, "auth.argon2_iterations must be positive")
+	check(c.Auth.PasswordMinLength > 0, "auth.password_min_length must be positive")
+	check(c.Auth.PasswordMaxBytes >= c.Auth.PasswordMinLength, "auth.password_max_bytes must be at least auth.password_min_length")
+	check(c.Auth.PasswordHash != "bcrypt" || c.Auth.PasswordMaxBytes <= 72, "auth.password_max_bytes %d exceeds the 72 bytes bcrypt hashes", c.Auth.PasswordMaxBytes)
+	check(c.Auth.PasswordMinClasses >= 0 && c.Auth.PasswordMinClasses <= 4, "auth.password_min_classes %d must be between 0 and 4", c.Auth.PasswordMinClasses)
+	check(c.Auth.LockoutFreeAttempts > 0, "auth.lockout_free_attempts must be positive")
+	check(c.Auth.LockoutMaxAttempts >= c.Auth.LockoutFreeAttempts, "auth.lockout_max_attempts must be at least auth.lockout_free_attempts")
+	check(c.Auth.LockoutIPFreeAttempts > 0, "auth.lockout_ip_free_attempts must be positive")
+	check(c.Auth.LockoutIPMaxAttempts >= c.Auth.LockoutIPFreeAttempts, "auth.lockout_ip_max_attempts must be at least auth.lockout_ip_free_attempts")
+	check(c.Auth.LockoutBaseDelay > 0, "auth.lockout_base_delay must be positive")
+	check(c.Auth.LockoutDuration > 0, "auth.lockout_duration must be positive")
+	check(c.Auth.LockoutResetAfter > 0, "auth.lockout_reset_after must be positive")
+
+	check(c.Verification.TokenTTL > 0, "verification.token_ttl must be positive")
+	check(c.Verification.ResendEmailLimit > 0, "verification.resend_email_limit must be positive")
+	check(c.Verification.ResendIPLimit > 0, "verification.resend_ip_limit must be positive")
+	check(c.Verification.ResendWindow > 0, "verification.resend_window must be positive")
 
-	dsn := "host=" + dbHost + " user=" + dbUser + " dbname=" + dbName + " sslmode=disable password=" + dbPassword
-	// fmt.Println("DSN:", dsn)
+	switch c.Tracing.Exporter {
+	case "none", "stdout", "otlp":
+	default:
+		check(false, "tracing.exporter %q must be none, stdout or otlp", c.Tracing.Exporter)
+	}
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
 
-	return DBConfig{DSN: dsn}
+	return problems
 }
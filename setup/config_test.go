@@ -1,8 +1,11 @@
 package setup
 
 import (
+	"errors"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -23,3 +26,185 @@ func TestGetDBConfig(t *testing.T) {
 	os.Unsetenv("DB_PASSWORD")
 	os.Unsetenv("DB_NAME")
 }
+
+func TestGetDBConfigWithPort(t *testing.T) {
+	t.Setenv("DB_HOST", "localhost")
+	t.Setenv("DB_USER", "user")
+	t.Setenv("DB_PASSWORD", "pass word")
+	t.Setenv("DB_NAME", "dbname")
+	t.Setenv("DB_PORT", "5433")
+	t.Setenv("DB_SSLMODE", "require")
+
+	expectedDSN := "host=localhost user=user dbname=dbname sslmode=require password='pass word' port=5433"
+	assert.Equal(t, expectedDSN, GetDBConfig().DSN)
+}
+
+// testSigningKey satisfies the signing key check of the default pubsub
+// backend in tests about other settings.
+const testSigningKey = "0123456789abcdef0123456789abcdef"
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFileWithEnvOverrides(t *testing.T) {
+	path := writeConfigFile(t, `
+db:
+  host: db.internal
+  user: webapp
+  name: webapp
+  port: 5432
+  max_open_conns: 10
+log:
+  level: info
+server:
+  port: "9090"
+  read_timeout: 3s
+auth:
+  bcrypt_cost: 12
+`)
+	t.Setenv("TOKEN_SIGNING_KEY", testSigningKey)
+	t.Setenv("DB_NAME", "override")
+	t.Setenv("HTTP_READ_TIMEOUT", "7s")
+
+	config, err := LoadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "db.internal", config.DB.Host)
+	assert.Equal(t, "override", config.DB.Name)
+	assert.Equal(t, 10, config.DB.MaxOpenConns)
+	assert.Equal(t, "host=db.internal user=webapp dbname=override sslmode=disable password= port=5432", config.DB.DSN)
+	assert.Equal(t, "info", config.Log.Level)
+	assert.Equal(t, "9090", config.Server.Port)
+	assert.Equal(t, 7*time.Second, config.Server.ReadTimeout)
+	assert.Equal(t, 12, config.Auth.BcryptCost)
+	// Untouched settings keep their defaults.
+	assert.Equal(t, Default().Auth.AccessTokenTTL, config.Auth.AccessTokenTTL)
+}
+
+func TestLoadFileReportsEveryProblem(t *testing.T) {
+	path := writeConfigFile(t, `
+db:
+  sslmode: sometimes
+log:
+  level: loud
+auth:
+  bcrypt_cost: 50
+`)
+	t.Setenv("TOKEN_SIGNING_KEY", testSigningKey)
+	t.Setenv("HTTP_READ_TIMEOUT", "soon")
+
+	_, err := LoadFile(path)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("LoadFile() error = %v, want *ValidationError", err)
+	}
+	assert.Len(t, validationErr.Problems, 7)
+	assert.Contains(t, err.Error(), "HTTP_READ_TIMEOUT")
+	assert.Contains(t, err.Error(), "db.host (DB_HOST) is required")
+	assert.Contains(t, err.Error(), "db.sslmode")
+	assert.Contains(t, err.Error(), "log.level")
+	assert.Contains(t, err.Error(), "auth.bcrypt_cost")
+}
+
+func TestLoadFileRejectsUnknownKeys(t *testing.T) {
+	path := writeConfigFile(t, `
+db:
+  hostname: localhost
+`)
+
+	_, err := LoadFile(path)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "hostname")
+}
+
+func TestLoadRedactionOverrides(t *testing.T) {
+	path := writeConfigFile(t, `
+db:
+  host: localhost
+  user: webapp
+  name: webapp
+log:
+  redact:
+    client_ip: hash
+`)
+	t.Setenv("TOKEN_SIGNING_KEY", testSigningKey)
+	t.Setenv("LOG_REDACT", "username=mask, email=keep")
+
+	config, err := LoadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"client_ip": "hash", "username": "mask", "email": "keep"}, config.Log.Redact)
+
+	t.Setenv("LOG_REDACT", "username=shred")
+	_, err = LoadFile(path)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "log.redact")
+}
+
+// The image reads custom_image/webapp.yaml on start and on every reload.
+func TestLoadFileAcceptsImageConfig(t *testing.T) {
+	t.Setenv("TOKEN_SIGNING_KEY", testSigningKey)
+	t.Setenv("DB_HOST", "localhost")
+	t.Setenv("DB_USER", "webapp")
+	t.Setenv("DB_NAME", "webapp")
+
+	config, err := LoadFile("../custom_image/webapp.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, "info", config.Log.Level)
+	assert.Equal(t, "/var/log/webapp/webapp.log", config.Log.Path)
+}
+
+func TestLoadMetricsAddr(t *testing.T) {
+	path := writeConfigFile(t, `
+db:
+  host: localhost
+  user: webapp
+  name: webapp
+`)
+	t.Setenv("TOKEN_SIGNING_KEY", testSigningKey)
+
+	config, err := LoadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:9090", config.Server.MetricsAddr)
+
+	t.Setenv("METRICS_ADDR", "9090")
+	_, err = LoadFile(path)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "server.metrics_addr")
+}
+
+func TestLoadTokenSigningKey(t *testing.T) {
+	path := writeConfigFile(t, `
+db:
+  host: localhost
+  user: webapp
+  name: webapp
+`)
+
+	// The pubsub backend serves several instances, which need a shared key.
+	_, err := LoadFile(path)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "auth.token_signing_key (TOKEN_SIGNING_KEY) is required for the pubsub backend")
+
+	t.Setenv("TOKEN_SIGNING_KEY", "too-short")
+	_, err = LoadFile(path)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "must be at least 32 bytes")
+
+	t.Setenv("TOKEN_SIGNING_KEY", testSigningKey)
+	config, err := LoadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, testSigningKey, config.Auth.TokenSigningKey)
+
+	// Local backends fall back to a per-process key.
+	t.Setenv("TOKEN_SIGNING_KEY", "")
+	for _, backend := range []string{"memory", "file"} {
+		t.Setenv("PUBLISHER_BACKEND", backend)
+		t.Setenv("PUBLISHER_FILE_PATH", filepath.Join(t.TempDir(), "messages.jsonl"))
+		_, err = LoadFile(path)
+		assert.NoError(t, err, backend)
+	}
+}
@@ -0,0 +1,74 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	return recorder
+}
+
+func TestInjectExtractRoundTrip(t *testing.T) {
+	recordSpans(t)
+	ctx, span := Tracer().Start(context.Background(), "producer")
+	defer span.End()
+
+	attributes := Inject(ctx, map[string]string{"email": "a@example.com"})
+	assert.Equal(t, "a@example.com", attributes["email"])
+	assert.Contains(t, attributes, "traceparent")
+
+	extracted := trace.SpanContextFromContext(Extract(context.Background(), attributes))
+	assert.Equal(t, span.SpanContext().TraceID(), extracted.TraceID())
+	assert.Equal(t, span.SpanContext().SpanID(), extracted.SpanID())
+}
+
+func TestGormPluginCreatesChildSpans(t *testing.T) {
+	recorder := recordSpans(t)
+
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost"}), &gorm.Config{
+		DryRun:               true,
+		DisableAutomaticPing: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Use(GormPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+
+	type widget struct {
+		ID   int
+		Name string
+	}
+	ctx, parent := Tracer().Start(context.Background(), "request")
+	db.WithContext(ctx).Where("name = ?", "secret").Find(&[]widget{})
+	parent.End()
+
+	spans := recorder.Ended()
+	if assert.Len(t, spans, 2) {
+		query := spans[0]
+		assert.Equal(t, "gorm.query widgets", query.Name())
+		assert.Equal(t, trace.SpanKindClient, query.SpanKind())
+		assert.Equal(t, parent.SpanContext().SpanID(), query.Parent().SpanID())
+		for _, attr := range query.Attributes() {
+			if attr.Key == "db.statement" {
+				assert.NotContains(t, attr.Value.AsString(), "secret")
+			}
+		}
+	}
+}
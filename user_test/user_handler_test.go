@@ -2,6 +2,7 @@ package usertest
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -10,10 +11,12 @@ import (
 	"os"
 	"testing"
 	"webapp/api/user"
+	dbpkg "webapp/db"
+	"webapp/db/migrations"
 	"webapp/logger"
 	"webapp/router"
 
-	"gorm.io/driver/postgres"
+	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
@@ -28,7 +31,9 @@ func setupTestDatabase() *gorm.DB {
 
 	dsn := fmt.Sprintf("host=%s user=%s password=%s dbname=%s port=%s sslmode=disable", host, user, password, dbName, port)
 
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	// Open the connection the way main does, so constraint violations are
+	// translated and queries logged the same.
+	db, err := dbpkg.Open(dsn)
 	if err != nil {
 		panic("failed to connect database")
 	}
@@ -36,12 +41,16 @@ func setupTestDatabase() *gorm.DB {
 }
 
 func teardownDatabase() {
-	db.Migrator().DropTable(&user.UserModel{})
+	sqlDB, _ := db.DB()
+	migrations.Down(context.Background(), sqlDB, -1, true)
 }
 
 func TestMain(m *testing.M) {
 	db = setupTestDatabase()
-	err := db.AutoMigrate(&user.UserModel{})
+	sqlDB, err := db.DB()
+	if err == nil {
+		_, err = migrations.Up(context.Background(), sqlDB)
+	}
 	if err != nil {
 		fmt.Println("Failed to migrate testtable schema")
 		logger.Logger.Error("TestMain() - Failed to migrate testtable schema")
@@ -57,6 +66,14 @@ func basicAuth(username, password string) string {
 	return base64.StdEncoding.EncodeToString([]byte(auth))
 }
 
+// relayOutbox publishes the queued outbox messages to publisher, as the
+// OutboxRelay started by main does.
+func relayOutbox(t *testing.T, publisher user.Publisher) {
+	if err := user.NewOutboxRelay(user.NewPostgresRepository(dbpkg.NewStaticProvider(db)), publisher).Drain(context.Background()); err != nil {
+		t.Fatalf("Failed to relay outbox: %v", err)
+	}
+}
+
 func unmarshalResponseBody(t *testing.T, body *bytes.Buffer) map[string]interface{} {
 	var responseBody map[string]interface{}
 	err := json.Unmarshal(body.Bytes(), &responseBody)
@@ -67,7 +84,8 @@ func unmarshalResponseBody(t *testing.T, body *bytes.Buffer) map[string]interfac
 }
 
 func TestCreateAndGetUser(t *testing.T) {
-	r := router.InitRouter(db)
+	publisher := user.NewMemoryPublisher()
+	r := router.InitRouter(dbpkg.NewStaticProvider(db), publisher)
 
 	defer func() {
 		db.Where("username = ?", "john.doe@example.com").Delete(&user.UserModel{})
@@ -83,12 +101,22 @@ func TestCreateAndGetUser(t *testing.T) {
 	userDataBytes, _ := json.Marshal(userData)
 	req, _ := http.NewRequest("POST", "/v6/user", bytes.NewBuffer(userDataBytes))
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-ID", "create-user-test")
 	w := httptest.NewRecorder()
 	r.ServeHTTP(w, req)
 
 	if w.Code != http.StatusCreated {
 		t.Fatalf("Expected status code %d, got %d for valid user creation", http.StatusCreated, w.Code)
 	}
+	if got := w.Header().Get("X-Request-ID"); got != "create-user-test" {
+		t.Fatalf("Expected X-Request-ID to be echoed, got %q", got)
+	}
+
+	relayOutbox(t, publisher)
+	messages := publisher.VerificationMessages(user.VerificationTopic)
+	if len(messages) != 1 || messages[0].Email != userData["username"] {
+		t.Fatalf("Expected one verification message for %s, got %v", userData["username"], messages)
+	}
 
 	//bypass email verification in TEST
 	db.Model(&user.UserModel{}).Where("username = ?", "john.doe@example.com").Update("is_verified", true)
@@ -113,7 +141,7 @@ func TestCreateAndGetUser(t *testing.T) {
 }
 
 func TestUpdateAndGetUser(t *testing.T) {
-	r := router.InitRouter(db)
+	r := router.InitRouter(dbpkg.NewStaticProvider(db), user.NewMemoryPublisher())
 	// Step 1: Create a user directly in the database for testing
 	testUser := user.UserModel{
 		FirstName: "Johny",
@@ -172,3 +200,391 @@ func TestUpdateAndGetUser(t *testing.T) {
 	// fmt.Println("ALL TESTS PASSED in TestUpdateAndGetUser() !!!")
 	logger.Logger.Error("TestUpdateAndGetUser() - ALL TESTS PASSED!!!")
 }
+
+func TestVerifyUser(t *testing.T) {
+	publisher := user.NewMemoryPublisher()
+	r := router.InitRouter(dbpkg.NewStaticProvider(db), publisher)
+
+	defer func() {
+		db.Where("username = ?", "jane.verify@example.com").Delete(&user.UserModel{})
+		db.Where("email = ?", "jane.verify@example.com").Delete(&user.EmailVerification{})
+	}()
+
+	userData := map[string]string{
+		"first_name": "Jane",
+		"last_name":  "Verify",
+		"username":   "jane.verify@example.com",
+		"password":   "password123",
+	}
+	userDataBytes, _ := json.Marshal(userData)
+	req, _ := http.NewRequest("POST", "/v6/user", bytes.NewBuffer(userDataBytes))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d for valid user creation", http.StatusCreated, w.Code)
+	}
+
+	relayOutbox(t, publisher)
+	messages := publisher.VerificationMessages(user.VerificationTopic)
+	if len(messages) != 1 {
+		t.Fatalf("Expected one verification message, got %d", len(messages))
+	}
+	token := messages[0].VerificationToken
+
+	// The token must not simply be the user's ID
+	var created user.UserModel
+	db.Where("username = ?", userData["username"]).First(&created)
+	if token == created.ID.String() {
+		t.Fatalf("Verification token leaks the user ID")
+	}
+
+	req, _ = http.NewRequest("GET", "/verify?token="+token, nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d for valid verification", http.StatusOK, w.Code)
+	}
+
+	db.Where("username = ?", userData["username"]).First(&created)
+	if !created.IsVerified {
+		t.Fatalf("Expected user to be verified")
+	}
+
+	// Tokens are single use
+	req, _ = http.NewRequest("GET", "/verify?token="+token, nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected status code %d, got %d for reused token", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestResendVerification(t *testing.T) {
+	publisher := user.NewMemoryPublisher()
+	r := router.InitRouter(dbpkg.NewStaticProvider(db), publisher)
+
+	defer func() {
+		db.Where("username = ?", "jane.resend@example.com").Delete(&user.UserModel{})
+		db.Where("email = ?", "jane.resend@example.com").Delete(&user.EmailVerification{})
+	}()
+
+	userData := map[string]string{
+		"first_name": "Jane",
+		"last_name":  "Resend",
+		"username":   "jane.resend@example.com",
+		"password":   "password123",
+	}
+	userDataBytes, _ := json.Marshal(userData)
+	req, _ := http.NewRequest("POST", "/v6/user", bytes.NewBuffer(userDataBytes))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d for valid user creation", http.StatusCreated, w.Code)
+	}
+
+	resendBody := []byte(`{"username": "jane.resend@example.com"}`)
+	req, _ = http.NewRequest("POST", "/v6/user/resend-verification", bytes.NewBuffer(resendBody))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status code %d, got %d for resend", http.StatusAccepted, w.Code)
+	}
+
+	relayOutbox(t, publisher)
+	messages := publisher.VerificationMessages(user.VerificationTopic)
+	if len(messages) != 2 {
+		t.Fatalf("Expected two verification messages, got %d", len(messages))
+	}
+
+	// The original token was rotated out
+	req, _ = http.NewRequest("GET", "/verify?token="+messages[0].VerificationToken, nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected status code %d, got %d for rotated token", http.StatusNotFound, w.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/verify?token="+messages[1].VerificationToken, nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d for new token", http.StatusOK, w.Code)
+	}
+}
+
+func TestLoginAndRefresh(t *testing.T) {
+	r := router.InitRouter(dbpkg.NewStaticProvider(db), user.NewMemoryPublisher())
+	testUser := user.UserModel{
+		FirstName:  "John",
+		LastName:   "Token",
+		Username:   "john.token@example.com",
+		Password:   "password@123",
+		IsVerified: true,
+	}
+	testUser.ID = uuid.New()
+	if err := testUser.HashPassword(); err != nil {
+		t.Fatalf("Error hashing password: %v", err)
+	}
+	if err := db.Create(&testUser).Error; err != nil {
+		t.Fatalf("Error creating test user: %v", err)
+	}
+
+	defer func() {
+		db.Where("user_id = ?", testUser.ID).Delete(&user.RefreshToken{})
+		db.Where("username = ?", "john.token@example.com").Delete(&user.UserModel{})
+	}()
+
+	req, _ := http.NewRequest("POST", "/v6/user/login", nil)
+	req.Header.Set("Authorization", "Basic "+basicAuth("john.token@example.com", "password@123"))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d for login", http.StatusOK, w.Code)
+	}
+	tokens := unmarshalResponseBody(t, w.Body)
+	accessToken, _ := tokens["access_token"].(string)
+	refreshToken, _ := tokens["refresh_token"].(string)
+
+	// The access token authenticates without a password
+	req, _ = http.NewRequest("GET", "/v6/user/self", nil)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d for bearer authentication", http.StatusOK, w.Code)
+	}
+
+	// Refresh tokens rotate
+	body := []byte(`{"refresh_token": "` + refreshToken + `"}`)
+	req, _ = http.NewRequest("POST", "/v6/user/token/refresh", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d for refresh", http.StatusOK, w.Code)
+	}
+
+	req, _ = http.NewRequest("POST", "/v6/user/token/refresh", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status code %d, got %d for reused refresh token", http.StatusUnauthorized, w.Code)
+	}
+
+	// A password change ends every session
+	req, _ = http.NewRequest("POST", "/v6/user/login", nil)
+	req.Header.Set("Authorization", "Basic "+basicAuth("john.token@example.com", "password@123"))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	tokens = unmarshalResponseBody(t, w.Body)
+	refreshToken, _ = tokens["refresh_token"].(string)
+
+	req, _ = http.NewRequest("PATCH", "/v6/user/self", bytes.NewBuffer([]byte(`{"password": "newpassword123"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status code %d, got %d for password change", http.StatusNoContent, w.Code)
+	}
+
+	body = []byte(`{"refresh_token": "` + refreshToken + `"}`)
+	req, _ = http.NewRequest("POST", "/v6/user/token/refresh", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status code %d, got %d for refresh after password change", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	publisher := user.NewMemoryPublisher()
+	r := router.InitRouter(dbpkg.NewStaticProvider(db), publisher)
+	testUser := user.UserModel{
+		FirstName:  "John",
+		LastName:   "Reset",
+		Username:   "john.reset@example.com",
+		Password:   "password@123",
+		IsVerified: true,
+	}
+	testUser.ID = uuid.New()
+	if err := testUser.HashPassword(); err != nil {
+		t.Fatalf("Error hashing password: %v", err)
+	}
+	if err := db.Create(&testUser).Error; err != nil {
+		t.Fatalf("Error creating test user: %v", err)
+	}
+
+	defer func() {
+		db.Where("username = ?", "john.reset@example.com").Delete(&user.UserModel{})
+	}()
+
+	body := []byte(`{"username": "john.reset@example.com"}`)
+	req, _ := http.NewRequest("POST", "/v6/user/password/reset/request", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status code %d, got %d for reset request", http.StatusAccepted, w.Code)
+	}
+
+	relayOutbox(t, publisher)
+	messages := publisher.Messages()
+	if len(messages) != 1 || messages[0].Topic != user.PasswordResetTopic {
+		t.Fatalf("Expected one password reset message, got %v", messages)
+	}
+	var resetMessage user.PasswordResetMessage
+	json.Unmarshal(messages[0].Data, &resetMessage)
+
+	body, _ = json.Marshal(map[string]string{
+		"token":    resetMessage.ResetToken,
+		"password": "newpassword123",
+	})
+	req, _ = http.NewRequest("POST", "/v6/user/password/reset", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status code %d, got %d for reset confirmation", http.StatusNoContent, w.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/v6/user/self", nil)
+	req.Header.Set("Authorization", "Basic "+basicAuth("john.reset@example.com", "newpassword123"))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d with the new password", http.StatusOK, w.Code)
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	r := router.InitRouter(dbpkg.NewStaticProvider(db), user.NewMemoryPublisher())
+	testUser := user.UserModel{
+		FirstName:  "John",
+		LastName:   "Patch",
+		Username:   "john.patch@example.com",
+		Password:   "password@123",
+		IsVerified: true,
+	}
+	testUser.ID = uuid.New()
+	if err := testUser.HashPassword(); err != nil {
+		t.Fatalf("Error hashing password: %v", err)
+	}
+	if err := db.Create(&testUser).Error; err != nil {
+		t.Fatalf("Error creating test user: %v", err)
+	}
+
+	defer func() {
+		db.Where("username = ?", "john.patch@example.com").Delete(&user.UserModel{})
+	}()
+
+	// Only the first name, without resending the password
+	body := []byte(`{"first_name": "Jack"}`)
+	req, _ := http.NewRequest("PATCH", "/v6/user/self", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Basic "+basicAuth("john.patch@example.com", "password@123"))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status code %d, got %d for partial update", http.StatusNoContent, w.Code)
+	}
+
+	// PUT still requires every field
+	req, _ = http.NewRequest("PUT", "/v6/user/self", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Basic "+basicAuth("john.patch@example.com", "password@123"))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status code %d, got %d for partial PUT", http.StatusBadRequest, w.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/v6/user/self", nil)
+	req.Header.Set("Authorization", "Basic "+basicAuth("john.patch@example.com", "password@123"))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	responseBody := unmarshalResponseBody(t, w.Body)
+	if responseBody["first_name"] != "Jack" || responseBody["last_name"] != "Patch" {
+		t.Fatalf("Expected first name Jack and last name Patch, got %v", responseBody)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	r := router.InitRouter(dbpkg.NewStaticProvider(db), user.NewMemoryPublisher())
+	testUser := user.UserModel{
+		FirstName:  "John",
+		LastName:   "Delete",
+		Username:   "john.delete@example.com",
+		Password:   "password@123",
+		IsVerified: true,
+	}
+	testUser.ID = uuid.New()
+	if err := testUser.HashPassword(); err != nil {
+		t.Fatalf("Error hashing password: %v", err)
+	}
+	if err := db.Create(&testUser).Error; err != nil {
+		t.Fatalf("Error creating test user: %v", err)
+	}
+
+	defer func() {
+		db.Unscoped().Where("username = ?", "john.delete@example.com").Delete(&user.UserModel{})
+	}()
+
+	req, _ := http.NewRequest("DELETE", "/v6/user/self", nil)
+	req.Header.Set("Authorization", "Basic "+basicAuth("john.delete@example.com", "password@123"))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status code %d, got %d for account deletion", http.StatusNoContent, w.Code)
+	}
+
+	// Deleted accounts can no longer log in
+	req, _ = http.NewRequest("GET", "/v6/user/self", nil)
+	req.Header.Set("Authorization", "Basic "+basicAuth("john.delete@example.com", "password@123"))
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected status code %d, got %d after deletion", http.StatusUnauthorized, w.Code)
+	}
+
+	// The username stays taken during the grace period
+	userData := map[string]string{
+		"first_name": "John",
+		"last_name":  "Again",
+		"username":   "john.delete@example.com",
+		"password":   "password123",
+	}
+	userDataBytes, _ := json.Marshal(userData)
+	req, _ = http.NewRequest("POST", "/v6/user", bytes.NewBuffer(userDataBytes))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected status code %d, got %d for reused username", http.StatusConflict, w.Code)
+	}
+}